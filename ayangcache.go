@@ -1,13 +1,14 @@
 package ayangcache
 
 import (
+	"context"
 	"fmt"
 	"github.com/ayanghuang/ayangcache/byteview"
 	"github.com/ayanghuang/ayangcache/cache"
-	"github.com/ayanghuang/ayangcache/peer"
 	"github.com/ayanghuang/ayangcache/singleflight"
-	"github.com/ayanghuang/ayangcache/transport"
 	"log"
+	"sync"
+	"time"
 )
 
 type Getter interface {
@@ -24,98 +25,234 @@ func (f GetterFunc) Get(key string) (byteview.ByteView, error) {
 	return f(key)
 }
 
+// ContextGetter 是 Getter 的变种，可以拿到调用方的 ctx（例如调用方剩余的超时时间），用于控制访问数据源的时间
+// 如果 NewGroup 传入的 Getter 同时实现了 ContextGetter，则优先调用 GetContext
+type ContextGetter interface {
+	GetContext(ctx context.Context, key string) (byteview.ByteView, error)
+}
+
+// ContextGetterFunc 同 GetterFunc，同时实现了 Getter 和 ContextGetter，所以可以直接传给 NewGroup
+type ContextGetterFunc func(ctx context.Context, key string) (byteview.ByteView, error)
+
+func (f ContextGetterFunc) GetContext(ctx context.Context, key string) (byteview.ByteView, error) {
+	return f(ctx, key)
+}
+
+func (f ContextGetterFunc) Get(key string) (byteview.ByteView, error) {
+	return f(context.Background(), key)
+}
+
+const (
+	// 热点缓存的空间为主缓存的 1/defaultHotCacheRatio
+	defaultHotCacheRatio = 8
+	// 访问频率超过 defaultHotKeyThreshold 才认为是热点 key
+	defaultHotKeyThreshold = 1
+)
+
+var (
+	mu sync.RWMutex
+	// 本进程所有的 Group，map(name, *Group)
+	groups = make(map[string]*Group)
+)
+
+// Group 一个 Group 就是一份独立的数据集（例如 users、products），拥有自己的数据源和缓存空间
+// 同一个节点上的所有 Group 共用一个服务端和注册中心，见 RegisterPeers
 type Group struct {
-	addr string
+	name string
 	// 从数据源取出缓存没有的数据
 	getter Getter
-	// 从缓存中获取数据
-	cache cache.Cache
-	// 获取远程节点信息
-	peers peer.Peer
-	// 即是客户端（内部又有服务端），负责发送请求
-	client transport.Transport
+	// 主缓存，保存本节点是所属节点的 key
+	mainCache cache.TypedCache[string, byteview.ByteView]
+	// 热点缓存，保存从远程节点获取的热点 key 的副本
+	// 为什么要分开？如果放在一起，远程节点的副本会把本节点真正负责的数据淘汰掉
+	hotCache cache.TypedCache[string, byteview.ByteView]
+	// 热点缓存的空间为主缓存的 1/hotCacheRatio
+	hotCacheRatio int64
+	// 主缓存中估计的访问频率超过 hotKeyThreshold 才加入热点缓存
+	hotKeyThreshold int
 	// 防止缓存击穿
 	loads singleflight.Group
+	// 哪些节点保存了本节点所属 key 的副本
+	holders *holders
+	// 统计信息
+	stats stats
+	// 快照文件，为空表示不保存，见 OptionSnapshot
+	snapshotPath string
+	// 主缓存的 L2 所在的目录，为空表示不开启，见 OptionL2
+	l2Dir      string
+	l2MaxBytes int64
+	// 主缓存和热点缓存都使用 slab store，见 OptionSlabStore
+	slabStore bool
 }
 
-// NewGroup numCount 为计数器的数量，建议为存储 item 的 10 倍，maxBytes 为最大字节数
-func NewGroup(addr, registerAddr string, getter Getter, numCount, maxBytes int64, codecType string) *Group {
+// NewGroup numCount 为计数器的数量，建议为存储 item 的 10 倍，maxBytes 为主缓存的最大字节数
+// 热点缓存的计数器数量和最大字节数为主缓存的 1/hotCacheRatio，见 OptionHotCacheRatio
+// 同名的 Group 只能创建一次
+func NewGroup(name string, getter Getter, numCount, maxBytes int64, fns ...optionFn) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
 
+	group := registerGroup(name, getter, numCount, maxBytes, fns)
+	// 读文件可能比较慢，不能持有 mu，否则会阻塞所有的 GetGroup。加载期间的请求只是没有命中缓存
+	group.loadSnapshot()
+	return group
+}
+
+// registerGroup 创建 Group 并加入 groups
+func registerGroup(name string, getter Getter, numCount, maxBytes int64, fns []optionFn) *Group {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := groups[name]; ok {
+		panic("duplicate registration of group " + name)
+	}
+
 	group := &Group{
-		addr:   addr,
-		getter: getter,
-		cache:  cache.NewCache(numCount, maxBytes),
-		peers:  peer.NewPeer(addr, registerAddr),
-		loads:  singleflight.NewGroup(),
+		name:            name,
+		getter:          getter,
+		hotCacheRatio:   defaultHotCacheRatio,
+		hotKeyThreshold: defaultHotKeyThreshold,
+		loads:           singleflight.NewGroup(),
 	}
+	group.holders = newHolders(func(key string) bool {
+		_, ok := group.mainCache.Peek(key)
+		return ok
+	})
 
-	// 通过闭包来捕获当前 Group，传递给下一层依赖。
-	getValueFunc := func() transport.GetValueFunc {
-		return func(key string) (byteview.ByteView, error) {
-			return group.Get(key)
-		}
+	for i := range fns {
+		fns[i](group)
+	}
+
+	hotNumCount, hotMaxBytes := numCount/group.hotCacheRatio, maxBytes/group.hotCacheRatio
+	if hotNumCount == 0 {
+		hotNumCount = 1
 	}
-	group.client = transport.NewTransport(addr, codecType, getValueFunc())
+	if hotMaxBytes == 0 {
+		hotMaxBytes = 1
+	}
+	var mainOpts, hotOpts []cache.Option
+	if group.slabStore {
+		mainOpts = append(mainOpts, cache.OptionSlabStore(valueCodec))
+		hotOpts = append(hotOpts, cache.OptionSlabStore(valueCodec))
+	}
+	if group.snapshotPath != "" {
+		// 保存快照需要原始的 key，hash 重启后不变才能连同 TinyLFU 一起保存
+		mainOpts = append(mainOpts, cache.OptionKeepKeys(), cache.OptionStableHash())
+	}
+	if group.l2Dir != "" {
+		mainOpts = append(mainOpts, cache.OptionL2(group.l2Dir, group.l2MaxBytes, valueCodec))
+	}
+	group.mainCache = cache.New[string, byteview.ByteView](numCount, maxBytes, mainOpts...)
+	group.hotCache = cache.New[string, byteview.ByteView](hotNumCount, hotMaxBytes, hotOpts...)
+	groups[name] = group
 
 	return group
 }
 
-func (g *Group) Get(key string) (byteview.ByteView, error) {
+// GetGroup 根据名字获取 Group，没有则返回 nil
+func GetGroup(name string) *Group {
+	mu.RLock()
+	g := groups[name]
+	mu.RUnlock()
+	return g
+}
+
+// Close 关闭 Group，之后可以用同样的名字重新创建
+// 如果是最后一个 Group，还会关闭本节点：先从注册中心注销，让其他节点不再把请求发过来，
+// 再等待正在处理的请求返回并关闭所有连接，最后才关闭缓存
+func (g *Group) Close() {
+	mu.Lock()
+	if groups[g.name] != g {
+		// 已经关闭了
+		mu.Unlock()
+		return
+	}
+	delete(groups, g.name)
+	last := len(groups) == 0
+	mu.Unlock()
+
+	// 必须在关闭本节点之前保存，否则不知道哪些 key 属于本节点
+	g.saveSnapshot()
+
+	if last {
+		closeNode()
+	}
+
+	g.mainCache.Close()
+	g.hotCache.Close()
+}
+
+// Name 返回 Group 的名字
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Get ctx 的超时时间会传递给远程节点和数据源，调用方放弃后它们也会尽快停止
+func (g *Group) Get(ctx context.Context, key string) (byteview.ByteView, error) {
 	if key == "" {
 		return byteview.ByteView{}, fmt.Errorf("key is required")
 	}
 
-	// 从缓存中获取
-	if v, ok := g.cache.Get(key); ok {
+	// 调用方已经放弃了
+	if err := ctx.Err(); err != nil {
+		return byteview.ByteView{}, err
+	}
 
-		log.Println(g.addr, "hit cache", "key:", key, "value", v.(byteview.ByteView).String())
+	g.stats.gets.Add(1)
 
-		return v.(byteview.ByteView), nil
+	// 从缓存中获取
+	if v, ok := g.lookupCache(key); ok {
+		g.stats.cacheHits.Add(1)
+		return v, nil
 	}
 
-	return g.load(key)
+	g.stats.loads.Add(1)
+	return g.load(ctx, key)
 }
 
 // load
 // 1.先判断是否应该从远程结点获取，
 // 2. 1. 是，从远程结点获取，获取失败再尝试从数据源获取
 // 2. 2. 否，直接从数据源获取
-func (g *Group) load(key string) (byteview.ByteView, error) {
+// 注意：并发的请求只有第一个会真正执行，所以用的是第一个请求的 ctx
+func (g *Group) load(ctx context.Context, key string) (byteview.ByteView, error) {
 	var err error
 	value, err := g.loads.Do(key, func() (interface{}, error) {
 
 		// 再次尝试从缓存中取（原因：判断本地没有和从缓存中取不是原子的，从远程获取后会尝试放入本地缓存）
-		if val, ok := g.cache.Get(key); ok {
-
-			log.Println(g.addr, "hit cache", "key:", key, "value", val.(byteview.ByteView).String())
-
+		if val, ok := g.lookupCache(key); ok {
 			return val, nil
 		}
 
-		if g.peers != nil {
+		g.stats.loadsDeduped.Add(1)
+
+		if n := getNode(); n != nil {
 			// 获取发送的远程节点
-			if peerAddr := g.peers.GetPeer(key); peerAddr != "" {
+			if peerAddr := n.peers.GetPeer(key); peerAddr != "" {
 				// 从远程节点获取
-				bytes, err := g.client.GetFromPeer(peerAddr, key)
+				bytes, err := n.client.GetFromPeer(ctx, peerAddr, g.name, key)
 				if err == nil {
+					g.stats.peerLoads.Add(1)
 
-					log.Println(g.addr, "get from peer", peerAddr, "key:", key, "value:", string(bytes))
+					log.Println(n.addr, g.name, "get from peer", peerAddr, "key:", key, "value:", string(bytes))
 
-					// 尝试加入本地缓存
-					// 应该设置本地和远程节点缓存的空间比例，而且还应该设置判断是否为 hotkey
-					// 这里简单实现了异地缓存，只是利用了缓存的准入原则，且没有空间比例
+					// 是热点 key 才加入热点缓存
 					val := byteview.NewByteView(bytes)
-					g.populateCache(key, val)
+					g.populateHotCache(key, val)
 					return val, nil
 				}
+				g.stats.peerErrors.Add(1)
 			}
 		}
 
+		// 远程节点因为超时失败的话，调用方已经放弃了，就没必要再访问数据源了
+		if err := ctx.Err(); err != nil {
+			return byteview.ByteView{}, err
+		}
+
 		// 从数据源获取并尝试加入缓存
-		val, err := g.getLocally(key)
+		val, err := g.getLocally(ctx, key)
 		if err != nil {
 			return byteview.ByteView{}, err
 		}
@@ -129,21 +266,188 @@ func (g *Group) load(key string) (byteview.ByteView, error) {
 	return byteview.ByteView{}, err
 }
 
+// lookupCache 先从主缓存获取，再从热点缓存获取
+// 注意：主缓存的 Get 不管是否命中都会增加频率，所以不是本节点所属的 key 的访问频率也会记录在主缓存的 TinyLFU 中
+func (g *Group) lookupCache(key string) (byteview.ByteView, bool) {
+	if v, ok := g.mainCache.Get(key); ok {
+
+		log.Println(g.name, "hit main cache", "key:", key, "value", v.String())
+
+		return v, true
+	}
+
+	if v, ok := g.hotCache.Get(key); ok {
+
+		log.Println(g.name, "hit hot cache", "key:", key, "value", v.String())
+
+		return v, true
+	}
+
+	return byteview.ByteView{}, false
+}
+
 func (g *Group) populateCache(key string, value byteview.ByteView) {
-	g.cache.Add(key, value, int64(value.Len()))
+	g.mainCache.Add(key, value, int64(value.Len()))
+}
+
+// populateHotCache 主缓存中估计的访问频率超过阈值，才加入热点缓存
+func (g *Group) populateHotCache(key string, value byteview.ByteView) bool {
+	if g.mainCache.Frequency(key) <= g.hotKeyThreshold {
+		return false
+	}
+	return g.hotCache.Add(key, value, int64(value.Len()))
+}
+
+// removeFromCache 同时从主缓存和热点缓存中删除
+// 为什么主缓存也要删除？节点变化后所属节点会变，以前的主缓存的 key 可能已经不属于本节点了
+func (g *Group) removeFromCache(key string) {
+	g.mainCache.Del(key)
+	g.hotCache.Del(key)
 }
 
 // 从本地数据源获取数据
-func (g *Group) getLocally(key string) (byteview.ByteView, error) {
+func (g *Group) getLocally(ctx context.Context, key string) (byteview.ByteView, error) {
+	var val byteview.ByteView
+	var err error
+
 	// 从数据源获取
-	val, err := g.getter.Get(key)
+	if getter, ok := g.getter.(ContextGetter); ok {
+		val, err = getter.GetContext(ctx, key)
+	} else {
+		val, err = g.getter.Get(key)
+	}
 	if err != nil {
+		g.stats.localLoadErrs.Add(1)
 		return byteview.ByteView{}, err
 	}
+	g.stats.localLoads.Add(1)
 
-	log.Println(g.addr, "get data from dataSource", "key:", key, "value:", val)
+	log.Println(g.name, "get data from dataSource", "key:", key, "value:", val)
 
 	// 尝试加入缓存中
 	g.populateCache(key, val)
 	return val, nil
 }
+
+// Set 修改 key 的缓存，ttl 为 0 表示不过期
+// 由 key 的所属节点修改，并通知所有保存了副本的节点删除副本
+// 注意：修改的只是缓存，数据源需要调用方自己修改，而且缓存仍然要经过准入策略，不保证一定能加入
+func (g *Group) Set(ctx context.Context, key string, value byteview.ByteView, ttl time.Duration) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+
+	if n := getNode(); n != nil {
+		if peerAddr := n.peers.GetPeer(key); peerAddr != "" {
+			// 本节点可能也保存了副本，先删除
+			g.removeFromCache(key)
+			return n.client.SetToPeer(ctx, peerAddr, g.name, key, value.ByteSlice(), ttl)
+		}
+	}
+
+	g.setLocally(ctx, key, value, ttl)
+	return nil
+}
+
+// Remove 删除 key 的缓存，同 Set
+func (g *Group) Remove(ctx context.Context, key string) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+
+	if n := getNode(); n != nil {
+		if peerAddr := n.peers.GetPeer(key); peerAddr != "" {
+			g.removeFromCache(key)
+			return n.client.RemoveFromPeer(ctx, peerAddr, g.name, key)
+		}
+	}
+
+	g.removeLocally(ctx, key)
+	return nil
+}
+
+// setLocally 本节点是所属节点
+func (g *Group) setLocally(ctx context.Context, key string, value byteview.ByteView, ttl time.Duration) {
+	// 热点缓存中可能有以前作为非所属节点时保存的副本
+	g.hotCache.Del(key)
+	g.mainCache.SetWithTTL(key, value, int64(value.Len()), ttl)
+
+	log.Println(g.name, "set", "key:", key, "value:", value.String())
+
+	g.invalidateHolders(ctx, key)
+}
+
+func (g *Group) removeLocally(ctx context.Context, key string) {
+	g.removeFromCache(key)
+
+	log.Println(g.name, "remove", "key:", key)
+
+	g.invalidateHolders(ctx, key)
+}
+
+// invalidateHolders 并发通知所有保存了副本的节点删除副本，等全部返回（或 ctx 超时）
+// 通知失败只打印日志，不影响本次修改
+func (g *Group) invalidateHolders(ctx context.Context, key string) {
+	n := getNode()
+	if n == nil {
+		return
+	}
+
+	addrs := g.holders.take(key)
+	wg := sync.WaitGroup{}
+	wg.Add(len(addrs))
+	for _, addr := range addrs {
+		addr := addr
+		go func() {
+			defer wg.Done()
+			if err := n.client.InvalidatePeer(ctx, addr, g.name, key); err != nil {
+				log.Println(g.name, "invalidate", addr, "key:", key, "err:", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type optionFn func(*Group)
+
+// OptionHotCacheRatio 热点缓存的空间为主缓存的 1/ratio，默认为 8
+func OptionHotCacheRatio(ratio int64) func(g *Group) {
+	return func(g *Group) {
+		if ratio > 0 {
+			g.hotCacheRatio = ratio
+		}
+	}
+}
+
+// OptionSnapshot 启动时从 path 加载主缓存的快照，Close 时把仍然属于本节点的 key 保存到 path
+// 这样重启后不用所有的 key 都重新访问数据源。热点缓存是其他节点的 key 的副本，不保存
+func OptionSnapshot(path string) func(g *Group) {
+	return func(g *Group) {
+		g.snapshotPath = path
+	}
+}
+
+// OptionL2 主缓存淘汰的 key 写入 dir 下的文件，最多 maxBytes 字节，主缓存没有命中时先查 L2，再从远程节点或数据源获取
+// 本节点的磁盘比内存便宜得多，适合 value 较大、数据源较慢的场景。热点缓存不开启
+func OptionL2(dir string, maxBytes int64) func(g *Group) {
+	return func(g *Group) {
+		g.l2Dir = dir
+		g.l2MaxBytes = maxBytes
+	}
+}
+
+// OptionSlabStore 主缓存和热点缓存的 value 存放在预先分配的大块内存中，key 很多时可以大幅减少 GC 的扫描，
+// 代价是每次命中都要复制一次 value
+func OptionSlabStore() func(g *Group) {
+	return func(g *Group) {
+		g.slabStore = true
+	}
+}
+
+// OptionHotKeyThreshold 从远程节点获取的 key，在主缓存中估计的访问频率超过 threshold 才加入热点缓存，默认为 1
+// 负数表示全部加入
+func OptionHotKeyThreshold(threshold int) func(g *Group) {
+	return func(g *Group) {
+		g.hotKeyThreshold = threshold
+	}
+}
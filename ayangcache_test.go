@@ -1,10 +1,13 @@
 package ayangcache
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/ayanghuang/ayangcache/byteview"
 	"github.com/ayanghuang/ayangcache/transport"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -34,57 +37,230 @@ func (source *mockDataSource) Get(key string) (byteview.ByteView, error) {
 
 func TestGroup_Get(t *testing.T) {
 	// etcdctl del --prefix "/ayangcache"
+	// 一个进程就是一个节点，另外的节点需要用其他进程启动，例如在另一个终端执行同样的测试并修改 addr
 	etcdEndPoint := "127.0.0.1:2379"
-	g1Addr, g2Addr, g3Addr := "127.0.0.1:5555", "127.0.0.1:6666", "127.0.0.1:7777"
+	RegisterPeers("127.0.0.1:5555", etcdEndPoint, transport.ProtobufType)
 
-	g1 := NewGroup(g1Addr, etcdEndPoint, dataSource, 2<<10, 2<<10, transport.ProtobufType)
-	g2 := NewGroup(g2Addr, etcdEndPoint, dataSource, 2<<10, 2<<10, transport.ProtobufType)
-	_ = NewGroup(g3Addr, etcdEndPoint, dataSource, 2<<10, 2<<10, transport.ProtobufType)
+	g := NewGroup("scores", dataSource, 2<<10, 2<<10)
 
-	var err error
+	for _, key := range []string{"tom", "ayang", "ayangcache", "nocache", "ayang"} {
+		v, err := g.Get(context.Background(), key)
+		if err != nil {
+			fmt.Println("-------------------", "err:", err.Error())
+		} else {
+			fmt.Println("-------------------", "value:", v.String())
+		}
+	}
+
+	time.Sleep(time.Second)
+	return
+}
+
+// TestGetGroup 多个 Group 互相独立，没有 RegisterPeers 时只从本地数据源获取
+func TestGetGroup(t *testing.T) {
+	users := NewGroup("users", dataSource, 2<<10, 2<<10)
+	products := NewGroup("products", GetterFunc(func(key string) (byteview.ByteView, error) {
+		return byteview.NewByteView([]byte("product_" + key)), nil
+	}), 2<<10, 2<<10)
 
-	v, err := g2.Get("tom")
-	if err != nil {
-		fmt.Println("-------------------", "err:", err.Error())
-	} else {
-		fmt.Println("-------------------", "value:", v.String())
+	if GetGroup("users") != users || GetGroup("products") != products {
+		t.Fatalf("GetGroup failed")
+	}
+	if GetGroup("nogroup") != nil {
+		t.Fatalf("GetGroup should return nil")
 	}
 
-	v, err = g1.Get("ayang")
-	if err != nil {
-		fmt.Println("-------------------", "err:", err.Error())
-	} else {
-		fmt.Println("-------------------", "value:", v.String())
+	if v, err := users.Get(context.Background(), "tom"); err != nil || v.String() != "tomValue" {
+		t.Fatalf("users Get failed")
+	}
+	if v, err := products.Get(context.Background(), "tom"); err != nil || v.String() != "product_tom" {
+		t.Fatalf("products Get failed")
 	}
 
-	v, err = g2.Get("ayangcache")
-	if err != nil {
-		fmt.Println("-------------------", "err:", err.Error())
-	} else {
-		fmt.Println("-------------------", "value:", v.String())
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("duplicate NewGroup should panic")
+		}
+	}()
+	NewGroup("users", dataSource, 2<<10, 2<<10)
+}
+
+// TestContextGetter ctx 会传递给数据源，已经放弃的请求不会访问数据源
+func TestContextGetter(t *testing.T) {
+	var called int
+	g := NewGroup("sessions", ContextGetterFunc(func(ctx context.Context, key string) (byteview.ByteView, error) {
+		called++
+		if _, ok := ctx.Deadline(); !ok {
+			return byteview.ByteView{}, errors.New("no deadline")
+		}
+		return byteview.NewByteView([]byte("session_" + key)), nil
+	}), 2<<10, 2<<10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if v, err := g.Get(ctx, "ayang"); err != nil || v.String() != "session_ayang" {
+		t.Fatalf("Get failed")
 	}
 
-	v, err = g1.Get("nocache")
-	if err != nil {
-		fmt.Println("-------------------", "err:", err.Error())
-	} else {
-		fmt.Println("-------------------", "value:", v.String())
+	canceled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	if _, err := g.Get(canceled, "tom"); err == nil {
+		t.Fatalf("canceled ctx should fail")
+	}
+	if called != 1 {
+		t.Fatalf("getter should be called once, but %d", called)
 	}
+}
+
+// TestGroup_SetRemove 没有 RegisterPeers 时，本节点就是所有 key 的所属节点
+func TestGroup_SetRemove(t *testing.T) {
+	g := NewGroup("carts", dataSource, 2<<10, 2<<10)
+	ctx := context.Background()
 
-	v, err = g1.Get("ayang")
-	if err != nil {
-		fmt.Println("-------------------", "err:", err.Error())
-	} else {
-		fmt.Println("-------------------", "value:", v.String())
+	if v, err := g.Get(ctx, "tom"); err != nil || v.String() != "tomValue" {
+		t.Fatalf("Get failed")
 	}
 
-	v, err = g2.Get("ayang")
-	if err != nil {
-		fmt.Println("-------------------", "err:", err.Error())
-	} else {
-		fmt.Println("-------------------", "value:", v.String())
+	if err := g.Set(ctx, "tom", byteview.NewByteView([]byte("tomValue2")), 0); err != nil {
+		t.Fatalf("Set failed")
+	}
+	// 加入缓存是异步的
+	g.mainCache.Wait()
+	if v, err := g.Get(ctx, "tom"); err != nil || v.String() != "tomValue2" {
+		t.Fatalf("Get after Set failed")
 	}
 
-	time.Sleep(time.Second)
-	return
+	if err := g.Remove(ctx, "tom"); err != nil {
+		t.Fatalf("Remove failed")
+	}
+	// 删除后从数据源获取
+	if v, err := g.Get(ctx, "tom"); err != nil || v.String() != "tomValue" {
+		t.Fatalf("Get after Remove failed")
+	}
+}
+
+// TestGroup_HotCache 远程节点获取的 key 只有是热点才加入热点缓存
+func TestGroup_HotCache(t *testing.T) {
+	g := NewGroup("hot", dataSource, 2<<10, 2<<10, OptionHotKeyThreshold(15))
+	zero := NewGroup("zeroHot", dataSource, 2<<10, 2<<10, OptionHotKeyThreshold(0))
+	all := NewGroup("allHot", dataSource, 2<<10, 2<<10, OptionHotKeyThreshold(-1), OptionHotCacheRatio(4))
+
+	if g.populateHotCache("jerry", byteview.NewByteView([]byte("jerryValue"))) {
+		t.Fatalf("jerry is not hot key")
+	}
+	// 频率等于阈值（都是 0）也不加入，必须超过
+	if zero.mainCache.Frequency("jerry") != 0 || zero.populateHotCache("jerry", byteview.NewByteView([]byte("jerryValue"))) {
+		t.Fatalf("frequency equal to threshold should not add to hot cache")
+	}
+	if !all.populateHotCache("jerry", byteview.NewByteView([]byte("jerryValue"))) {
+		t.Fatalf("negative threshold should add to hot cache")
+	}
+	all.hotCache.Wait()
+
+	if v, ok := all.lookupCache("jerry"); !ok || v.String() != "jerryValue" {
+		t.Fatalf("lookup hot cache failed")
+	}
+	// 热点缓存只有 1/4 的空间，放不下
+	if all.populateHotCache("big", byteview.NewByteView(make([]byte, 1<<10))) {
+		all.hotCache.Wait()
+		if _, ok := all.hotCache.Get("big"); ok {
+			t.Fatalf("big should not fit in hot cache")
+		}
+	}
+
+	all.removeFromCache("jerry")
+	if _, ok := all.lookupCache("jerry"); ok {
+		t.Fatalf("removeFromCache failed")
+	}
+}
+
+// TestGroup_Holders 主缓存淘汰的 key，在 holders 的数量增长一倍时被清理
+func TestGroup_Holders(t *testing.T) {
+	g := NewGroup("holders", dataSource, 1000, 100)
+	defer g.Close()
+
+	// 主缓存最多 100 个，其余的被淘汰或者没有通过准入
+	for i := 0; i < minHoldersSweep; i++ {
+		g.mainCache.Set(strconv.Itoa(i), byteview.NewByteView([]byte("v")), 1)
+	}
+	g.mainCache.Wait()
+	for i := 0; i < minHoldersSweep-1; i++ {
+		g.holders.add(strconv.Itoa(i), "peer")
+	}
+	if n := len(g.holders.m); n != minHoldersSweep-1 {
+		t.Fatalf("holders has %d keys, want %d", n, minHoldersSweep-1)
+	}
+
+	g.holders.add(strconv.Itoa(minHoldersSweep-1), "peer")
+	if n := len(g.holders.m); n > 101 {
+		t.Fatalf("holders has %d keys after sweep, want <= 101", n)
+	}
+	for key := range g.holders.m {
+		if _, ok := g.mainCache.Peek(key); !ok && key != strconv.Itoa(minHoldersSweep-1) {
+			t.Fatalf("%s is not in main cache but kept in holders", key)
+		}
+	}
+}
+
+func TestGroup_Stats(t *testing.T) {
+	g := NewGroup("stats", dataSource, 2<<10, 2<<10)
+	ctx := context.Background()
+
+	_, _ = g.Get(ctx, "tom")
+	g.mainCache.Wait()
+	_, _ = g.Get(ctx, "tom")
+	_, _ = g.Get(ctx, "nocache")
+
+	stats := g.Stats()
+	want := Stats{Gets: 3, CacheHits: 1, Loads: 2, LoadsDeduped: 2, LocalLoads: 1, LocalLoadErrs: 1}
+	if stats != want {
+		t.Fatalf("want %+v, but %+v", want, stats)
+	}
+}
+
+func TestGroup_Close(t *testing.T) {
+	g := NewGroup("close", dataSource, 2<<10, 2<<10)
+	g.Close()
+	if GetGroup("close") != nil {
+		t.Fatalf("group should be removed after close")
+	}
+	// 可以重复关闭
+	g.Close()
+
+	// 关闭后可以用同样的名字重新创建
+	g = NewGroup("close", dataSource, 2<<10, 2<<10)
+	defer g.Close()
+	if v, err := g.Get(context.Background(), "tom"); err != nil || v.String() != "tomValue" {
+		t.Fatalf("Get after recreate failed")
+	}
+}
+
+// TestGroup_Snapshot 关闭时保存快照，重新创建后不用再访问数据源
+func TestGroup_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	ctx := context.Background()
+
+	g := NewGroup("snapshot", dataSource, 2<<10, 2<<10, OptionSnapshot(path))
+	if err := g.Set(ctx, "tom", byteview.NewByteView([]byte("tomValue2")), 0); err != nil {
+		t.Fatalf("Set failed")
+	}
+	if err := g.Set(ctx, "ayang", byteview.NewByteView([]byte("ayangValue2")), time.Hour); err != nil {
+		t.Fatalf("Set failed")
+	}
+	g.mainCache.Wait()
+	g.Close()
+
+	// 数据源中没有 tom，只能从快照中获取
+	g = NewGroup("snapshot", GetterFunc(func(key string) (byteview.ByteView, error) {
+		return byteview.ByteView{}, errors.New("no this cache")
+	}), 2<<10, 2<<10, OptionSnapshot(path))
+	defer g.Close()
+	for key, want := range map[string]string{"tom": "tomValue2", "ayang": "ayangValue2"} {
+		if v, err := g.Get(ctx, key); err != nil || v.String() != want {
+			t.Fatalf("Get %s after restart = %v, %v, want %s", key, v, err, want)
+		}
+	}
+	if stats := g.Stats(); stats.LocalLoads != 0 {
+		t.Fatalf("LocalLoads = %d, want 0", stats.LocalLoads)
+	}
 }
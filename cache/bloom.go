@@ -0,0 +1,63 @@
+package cache
+
+const (
+	// bloomProbes 每个 key 在布隆过滤器中占几个位
+	bloomProbes = 4
+	// bloomMinBits 最少 64 位，也就是一个 uint64
+	bloomMinBits = 64
+)
+
+// bloom 布隆过滤器，TinyLFU 用它作为 doorkeeper：key 第一次访问只记录在这里，第二次访问才增加 cmSketch 的计数
+// 这样只访问一次的 key（长尾流量）就不会占用 cmSketch 的计数器，也不会让保鲜（reset）太快到来
+type bloom struct {
+	bits []uint64
+	// 位数为 2 的整数次幂，利用位运算快速取模
+	mask uint64
+}
+
+// newBloom numBits 为位数，会向上舍入为 2 的整数次幂
+// 和 cmSketch 的计数器数量一样，每个计数器 4 位，而这里只用 1 位，所以只多了 1/16 的内存
+func newBloom(numBits int64) *bloom {
+	if numBits < bloomMinBits {
+		numBits = bloomMinBits
+	}
+	numBits = next2Power(numBits)
+	return &bloom{
+		bits: make([]uint64, numBits/64),
+		mask: uint64(numBits - 1),
+	}
+}
+
+// location 双重哈希，用一个 hash 的高低 32 位模拟 bloomProbes 个 hash 函数
+func (b *bloom) location(hashKey uint64, i uint64) uint64 {
+	h1, h2 := hashKey, hashKey>>32|hashKey<<32
+	return (h1 + i*h2) & b.mask
+}
+
+func (b *bloom) has(hashKey uint64) bool {
+	for i := uint64(0); i < bloomProbes; i++ {
+		loc := b.location(hashKey, i)
+		if b.bits[loc/64]&(1<<(loc%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// addIfNotHas 已经存在返回 false，否则加入并返回 true
+func (b *bloom) addIfNotHas(hashKey uint64) bool {
+	if b.has(hashKey) {
+		return false
+	}
+	for i := uint64(0); i < bloomProbes; i++ {
+		loc := b.location(hashKey, i)
+		b.bits[loc/64] |= 1 << (loc % 64)
+	}
+	return true
+}
+
+func (b *bloom) clear() {
+	for i := range b.bits {
+		b.bits[i] = 0
+	}
+}
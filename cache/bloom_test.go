@@ -0,0 +1,37 @@
+package cache
+
+import "testing"
+
+func TestBloom(t *testing.T) {
+	b := newBloom(1024)
+
+	hashKey, _ := KeyToHash("ayang")
+	if b.has(hashKey) {
+		t.Fatalf("should not has")
+	}
+	if !b.addIfNotHas(hashKey) {
+		t.Fatalf("first add should return true")
+	}
+	if b.addIfNotHas(hashKey) || !b.has(hashKey) {
+		t.Fatalf("second add should return false")
+	}
+
+	b.clear()
+	if b.has(hashKey) {
+		t.Fatalf("clear failed")
+	}
+
+	// 误判率
+	for i := uint64(0); i < 100; i++ {
+		b.addIfNotHas(i * 0x9E3779B97F4A7C15)
+	}
+	var falsePositive int
+	for i := uint64(100); i < 1100; i++ {
+		if b.has(i * 0x9E3779B97F4A7C15) {
+			falsePositive++
+		}
+	}
+	if falsePositive > 50 {
+		t.Fatalf("false positive too high: %d/1000", falsePositive)
+	}
+}
@@ -1,57 +1,278 @@
 package cache
 
-import "time"
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
+)
 
 const (
 	addBufSize     = 1024 * 32
 	ringBufferSize = 64
 )
 
+// Cache 非泛型版本，key 支持的类型见 KeyToHash，不支持的类型会在运行时 panic
+// 内部就是 TypedCache[interface{}, interface{}]，只是多了 nil 的检查
 type Cache interface {
 	Get(key interface{}) (interface{}, bool)
+	// Peek 同 Get，但不会增加频率，也不会延长滑动过期时间，适合调试、管理接口读取缓存，不影响准入和淘汰
+	Peek(key interface{}) (interface{}, bool)
+	// GetWithInfo 同 Get（也会增加频率），同时返回 key 的 cost、加入时间、过期时间和估计的频率
+	// key 不在缓存中时 ItemInfo 只有 Frequency，可以用来解释为什么没有被准入
+	GetWithInfo(key interface{}) (interface{}, ItemInfo, bool)
+	// Add 加入缓存，key 已存在则不会覆盖
 	Add(key, val interface{}, cost int64) bool
 	AddWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool
+	// Set 加入缓存，key 已存在则覆盖 value、cost 和过期时间
+	Set(key, value interface{}, cost int64) bool
+	SetWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool
+	// GetTTL 返回剩余的过期时间，不会过期返回 0，不存在（或已过期）返回 false
+	GetTTL(key interface{}) (time.Duration, bool)
+	// Touch 修改过期时间，value 和 cost 不变，ttl 为 0 表示不再过期，不存在（或已过期）返回 false
+	Touch(key interface{}, ttl time.Duration) bool
+	// Del 删除缓存，同时从 store 和 policy 中删除
+	Del(key interface{})
+	// Clear 清空缓存，包括 store、policy（频率也会清空）和过期时间轮，返回时已经清空
+	Clear()
+	// Wait 阻塞直到调用前加入 addBuf 的所有操作都经过了 policy 和 store 的处理
+	// 例如 Add 后马上 Get，中间调用 Wait 就一定能拿到（除非被准入策略拒绝了）
+	Wait()
+	// Frequency 返回 key 被访问（Get）的估计频率，不管 key 是否在缓存中
+	// 注意：Get 是批量异步增加频率的，所以会有一些延迟
+	Frequency(key interface{}) int
+	// Range 遍历所有未过期的 key，fn 返回 false 时停止。每个分段加锁复制后再调用 fn，分段内是一致的，分段之间不是
+	// 没有开启 OptionKeepKeys 时不会保存原始的 key，fn 收到的 key 为 nil
+	// 不会增加频率，也不会延长滑动过期时间
+	Range(fn func(key, value interface{}, cost int64, expiration time.Time) bool)
+	// Scan 分页遍历，cursor 第一次传 0，之后传上一次返回的 next，next 为 0 表示遍历完了
+	// 每次至少返回 count 个（除非遍历完了），一个分段不会被拆开，所以可能比 count 多
+	Scan(cursor uint64, count int) (entries []Entry[interface{}, interface{}], next uint64)
+	// SaveSnapshot 把缓存写入 w，用于重启后恢复，keep 不为 nil 时只写入 keep 返回 true 的 key，需要开启 OptionKeepKeys
+	SaveSnapshot(w io.Writer, codec SnapshotCodec[interface{}, interface{}], keep func(key interface{}) bool) error
+	// LoadSnapshot 读取 SaveSnapshot 写入的快照并加入缓存，同时恢复频率，返回加入的 key 的数量
+	LoadSnapshot(r io.Reader, codec SnapshotCodec[interface{}, interface{}]) (int, error)
+	// Metrics 返回统计信息，没有通过 OptionMetrics 开启则返回 nil
+	Metrics() *Metrics
+	// Close 停止所有后台协程（process、policy 的 processItems 和过期清理的定时器），可以重复调用
+	// 关闭后 Get 总是返回 false，加入、删除都不再生效
+	Close()
+}
+
+// TypedCache 泛型版本，方法的含义同 Cache，但 key 和 value 的类型在编译期就确定了，不需要类型断言
+// 通过 New 或 NewWithHasher 创建
+type TypedCache[K any, V any] interface {
+	Get(key K) (V, bool)
+	Peek(key K) (V, bool)
+	GetWithInfo(key K) (V, ItemInfo, bool)
+	Add(key K, value V, cost int64) bool
+	AddWithTTL(key K, value V, cost int64, ttl time.Duration) bool
+	Set(key K, value V, cost int64) bool
+	SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool
+	GetTTL(key K) (time.Duration, bool)
+	Touch(key K, ttl time.Duration) bool
+	Del(key K)
+	Clear()
+	Wait()
+	Frequency(key K) int
+	Range(fn func(key K, value V, cost int64, expiration time.Time) bool)
+	Scan(cursor uint64, count int) (entries []Entry[K, V], next uint64)
+	SaveSnapshot(w io.Writer, codec SnapshotCodec[K, V], keep func(key K) bool) error
+	LoadSnapshot(r io.Reader, codec SnapshotCodec[K, V]) (int, error)
+	Metrics() *Metrics
+	Close()
+}
+
+// Entry Scan 返回的一个 key，Key 只有开启了 OptionKeepKeys 才有，否则为零值
+type Entry[K any, V any] struct {
+	Key        K
+	Value      V
+	Cost       int64
+	Expiration time.Time
+}
+
+// ItemInfo 缓存中一个 key 的元数据
+type ItemInfo struct {
+	Cost int64
+	// Created 加入缓存的时间，Set 覆盖时不变
+	Created time.Time
+	// Expiration 过期时间，零值表示不会过期
+	Expiration time.Time
+	// Frequency 估计的访问频率，同 Cache.Frequency
+	Frequency int
+}
+
+// ValueCodec value 和字节之间的转换，value 需要存放在内存以外的地方时使用，见 OptionL2 和 OptionSlabStore
+// Decode 的参数是副本，可以直接引用，不需要再复制
+type ValueCodec[V any] struct {
+	Encode func(value V) ([]byte, error)
+	Decode func(b []byte) (V, error)
 }
 
+type itemFlag byte
+
+const (
+	// itemNew 新加入，已存在则不处理
+	itemNew itemFlag = iota
+	// itemSet Set 时还不存在，但处理时可能已经被之前的 Add 加入了，此时需要覆盖
+	itemSet
+	// itemUpdate 已经在 store 中更新了，还需要更新 policy 中的 cost
+	itemUpdate
+	// itemDelete 删除
+	itemDelete
+	// itemClear 清空，处理完后 close(done) 通知调用方
+	itemClear
+	// itemWait 屏障，什么都不做，处理到它时说明之前的 item 都处理完了，close(done) 通知调用方
+	itemWait
+	// itemExpire Get 时发现过期已经从 store 删除了，还需要从 policy 和 expiration 中删除
+	itemExpire
+)
+
 // item 整合成一个 struct，方便函数传参
-type item struct {
+type item[V any] struct {
+	flag       itemFlag
 	hashKey    uint64
 	conflict   uint64
-	value      interface{}
+	key        interface{}
+	value      V
 	cost       int64
 	expiration time.Time
+	// sliding 滑动过期的时间，见 OptionSlidingTTL
+	sliding time.Duration
+	done    chan struct{}
 }
 
-type cache struct {
+func (i *item[V]) toStoreItem() storeItem[V] {
+	return storeItem[V]{
+		hashKey:    i.hashKey,
+		conflict:   i.conflict,
+		key:        i.key,
+		value:      i.value,
+		cost:       i.cost,
+		expiration: i.expiration,
+		sliding:    i.sliding,
+	}
+}
+
+type typedCache[K any, V any] struct {
+	// 把 key 转换为 hash，见 Hasher
+	hasher Hasher[K]
 	// 存储所有完整的（key，value）
-	store store
+	store store[V]
 	// 缓存淘汰和准入策略，与上面解耦，所以也会存储所有的 key
-	policy policy
-	// 需要增加缓存丢入这个 chan，协程异步处理
-	addBuf chan *item
+	policy Policy
+	// 需要增加、更新、删除缓存丢入这个 chan，协程异步处理
+	// 所有对 policy 的修改都经过这个 chan 由一个协程处理，这样同一个 key 的操作顺序就能得到保证
+	addBuf chan *item[V]
 	// 获取缓存后，需要修改缓存获取频率（LFU）或移到队首（LRU）等操作，直接丢入这个 buffer，有异步协程调用 policy 提供的接口处理
 	getBuf ringBuffer
-	// 循环定时器，每隔一段时间触发并调用 expiration.Clean 扫描过去一段时间过期的 key 并清除
-	cleanupTicker *time.Ticker
-	// 按过期时间分桶存储 key，定期删除一部分 key
+	// 循环定时器，每个 tick 触发一次并调用 expiration.Clean 扫描过去一段时间过期的 key 并清除
+	cleanupTicker clock.Ticker
+	// 按过期时间把 key 放到时间轮中，定期删除已过期的 key
 	expiration expiration
+	// 所有需要当前时间的地方都用它，见 OptionClock
+	clock clock.Clock
+	// 统计信息，为 nil 表示不统计
+	metrics *Metrics
+	// addBuf 满了时加入最多阻塞多久，为 0 表示不阻塞直接丢弃，见 OptionBlockingAdd
+	addTimeout time.Duration
+	// 每次 Get 都延长过期时间，见 OptionSlidingTTL
+	sliding bool
+	// 在 store 中保存原始的 key，见 OptionKeepKeys
+	keepKeys bool
+	// 使用 StableKeyToHash，hash 重启后不变，快照才能保存 TinyLFU 的计数器，见 SaveSnapshot
+	stableHash bool
+	// 从 L1（store）淘汰的 value 写入 l2，为 nil 表示没有开启，见 OptionL2
+	l2      *fileStore
+	l2Codec ValueCodec[V]
+	// 关闭信号，close 后 process 退出，阻塞在 addBuf 上的调用方也会返回
+	stop    chan struct{}
+	closeDo sync.Once
+	// process 退出后 close
+	done chan struct{}
 }
 
 // NewCache
 // numCount 表示计数器的数量，建议为实际最大存储数量的 10 倍
 // maxCost 为最大存储 cost 总数
-func NewCache(numCount, maxCost int64, fns ...optionFn) Cache {
-	c := &cache{
-		store:         newShareStore(),
-		policy:        newDefaultPolicy(numCount, maxCost),
-		addBuf:        make(chan *item, addBufSize),
-		expiration:    newExpirationMap(),
-		cleanupTicker: time.NewTicker(time.Duration(ticker)),
+func NewCache(numCount, maxCost int64, fns ...Option) Cache {
+	return &cache{
+		typedCache: newTypedCache[interface{}, interface{}](numCount, maxCost, nil, fns),
 	}
-	c.getBuf = newRingBufferPool(c.policy, ringBufferSize)
+}
 
+// New 泛型版本的 NewCache，key 的类型见 Key，不支持的类型在编译期就能发现
+func New[K Key, V any](numCount, maxCost int64, fns ...Option) TypedCache[K, V] {
+	return newTypedCache[K, V](numCount, maxCost, nil, fns)
+}
+
+// NewWithHasher key 为结构体等 Key 不支持的类型时，需要自己提供 hash 函数，此时 OptionStableHash 不起作用
+func NewWithHasher[K comparable, V any](numCount, maxCost int64, hasher Hasher[K], fns ...Option) TypedCache[K, V] {
+	if hasher == nil {
+		panic("nil Hasher")
+	}
+	return newTypedCache[K, V](numCount, maxCost, hasher, fns)
+}
+
+// newTypedCache hasher 为 nil 时根据 OptionStableHash 选择 KeyToHash 或 StableKeyToHash
+func newTypedCache[K any, V any](numCount, maxCost int64, hasher Hasher[K], fns []Option) *typedCache[K, V] {
+	cfg := &config{
+		ringBufferSize: ringBufferSize,
+		newPolicy:      NewDefaultPolicy,
+		ttlTick:        defaultTTLTick,
+		clock:          clock.Real,
+	}
 	for i := range fns {
-		fns[i](c)
+		fns[i](cfg)
+	}
+	if cfg.ttlTick <= 0 {
+		cfg.ttlTick = defaultTTLTick
+	}
+	if cfg.clock == nil {
+		cfg.clock = clock.Real
+	}
+	// 自己提供的 hasher 不知道是不是稳定的
+	stableHash := hasher == nil && cfg.stableHash
+	if hasher == nil {
+		hasher = defaultHasher[K](cfg.stableHash)
+	}
+	var l2Codec ValueCodec[V]
+	if cfg.l2Dir != "" {
+		l2Codec = valueCodec[V](cfg.l2Codec)
+	}
+
+	c := &typedCache[K, V]{
+		hasher:        hasher,
+		policy:        cfg.newPolicy(numCount, maxCost),
+		addBuf:        make(chan *item[V], addBufSize),
+		expiration:    newTimingWheel(cfg.clock, cfg.ttlTick),
+		cleanupTicker: cfg.clock.NewTicker(cfg.ttlTick),
+		clock:         cfg.clock,
+		addTimeout:    cfg.addTimeout,
+		sliding:       cfg.sliding,
+		keepKeys:      cfg.keepKeys,
+		stableHash:    stableHash,
+		l2Codec:       l2Codec,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if cfg.slabCodec != nil {
+		c.store = newSlabStore[V](cfg.clock, c.onExpire, valueCodec[V](cfg.slabCodec))
+	} else {
+		c.store = newShareStore[V](cfg.clock, c.onExpire, cfg.shards)
+	}
+	c.getBuf = newRingBufferPool(c.policy, cfg.ringBufferSize)
+	if cfg.metrics {
+		c.metrics = newMetrics()
+		c.policy.CollectMetrics(c.metrics)
+	}
+	if cfg.l2Dir != "" {
+		l2, err := newFileStore(cfg.l2Dir, cfg.l2MaxBytes, cfg.clock, cfg.ttlTick, c.metrics)
+		if err != nil {
+			panic(err)
+		}
+		c.l2 = l2
 	}
 
 	// 开启守护协程异步处理
@@ -60,51 +281,230 @@ func NewCache(numCount, maxCost int64, fns ...optionFn) Cache {
 	return c
 }
 
-func (c *cache) Get(key interface{}) (interface{}, bool) {
-	if key == nil {
-		return nil, false
+func (c *typedCache[K, V]) Get(key K) (V, bool) {
+	var zero V
+	if c.isClosed() {
+		return zero, false
 	}
 
-	hashKey, conflict := KeyToHash(key)
+	hashKey, conflict := c.hasher(key)
 
 	// 获取缓存，所以需要增加该键的频率
 	// 注意：不管该键存不存在缓存中，都需要增加。因为有准入策略。
 	c.getBuf.Push(hashKey)
 
 	if v, ok := c.store.Get(hashKey, conflict); ok {
+		c.metrics.add(hit, hashKey, 1)
 		return v, true
 	}
 
-	return nil, false
+	c.metrics.add(miss, hashKey, 1)
+	if c.l2 != nil {
+		i, ok := c.getL2(key, hashKey, conflict)
+		return i.value, ok
+	}
+	return zero, false
 }
 
-func (c *cache) Add(key, value interface{}, cost int64) bool {
+// getL2 L1 没有命中时从 L2 获取，命中则重新加入 L1（同样要经过准入策略），L2 中的不删除，
+// 这样即使没有被准入也不会丢失，之后 Set 或 Del 时再从 L2 删除
+// 返回的 item 的 created 为现在，也就是重新加入 L1 的时间
+func (c *typedCache[K, V]) getL2(key K, hashKey, conflict uint64) (storeItem[V], bool) {
+	b, e, ok := c.l2.Get(hashKey, conflict)
+	if !ok {
+		c.metrics.add(l2Miss, hashKey, 1)
+		return storeItem[V]{}, false
+	}
+	value, err := c.l2Codec.Decode(b)
+	if err != nil {
+		c.l2.Del(hashKey, conflict)
+		c.metrics.add(l2Miss, hashKey, 1)
+		return storeItem[V]{}, false
+	}
+	c.metrics.add(l2Hit, hashKey, 1)
+
+	i := &item[V]{
+		flag:       itemNew,
+		hashKey:    hashKey,
+		conflict:   e.conflict,
+		value:      value,
+		cost:       e.cost,
+		expiration: e.expiration,
+		sliding:    e.sliding,
+	}
+	if c.keepKeys {
+		i.key = key
+	}
+	// 丢入 addBuf 之后 item 属于 process，先复制
+	res := i.toStoreItem()
+	res.created = c.clock.Now()
+	c.push(i)
+	return res, true
+}
+
+func (c *typedCache[K, V]) Peek(key K) (V, bool) {
+	var zero V
+	if c.isClosed() {
+		return zero, false
+	}
+
+	hashKey, conflict := c.hasher(key)
+	if i, ok := c.store.Peek(hashKey, conflict); ok {
+		return i.value, true
+	}
+	return zero, false
+}
+
+func (c *typedCache[K, V]) GetWithInfo(key K) (V, ItemInfo, bool) {
+	var zero V
+	if c.isClosed() {
+		return zero, ItemInfo{}, false
+	}
+
+	// 同 Get，但 value 和 cost、过期时间是 store 同一次加锁读取的，不会来自不同的 item
+	hashKey, conflict := c.hasher(key)
+	c.getBuf.Push(hashKey)
+
+	i, ok := c.store.GetItem(hashKey, conflict)
+	if ok {
+		c.metrics.add(hit, hashKey, 1)
+	} else {
+		c.metrics.add(miss, hashKey, 1)
+		if c.l2 != nil {
+			i, ok = c.getL2(key, hashKey, conflict)
+		}
+	}
+
+	info := ItemInfo{
+		Frequency: c.policy.Frequency(hashKey),
+	}
+	if !ok {
+		return zero, info, false
+	}
+	info.Cost = i.cost
+	info.Created = i.created
+	info.Expiration = i.expiration
+	return i.value, info, true
+}
+
+func (c *typedCache[K, V]) Add(key K, value V, cost int64) bool {
 	return c.AddWithTTL(key, value, cost, 0*time.Second)
 }
 
-func (c *cache) AddWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool {
-	if key == nil || value == nil || cost == 0 {
+func (c *typedCache[K, V]) AddWithTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	i, ok := c.newItem(key, value, cost, ttl)
+	if !ok {
 		return false
 	}
+	// L2 中的是旧的值，不删除的话 L1 没有准入时 Get 会拿到它
+	if c.l2 != nil {
+		c.l2.Del(i.hashKey, i.conflict)
+	}
+
+	return c.push(i)
+}
 
-	var expiration time.Time
-	switch {
-	case ttl == 0:
-		// 没有过期时间，后期用 time.IsZero 判断即可
-		break
-	case ttl < 0:
+func (c *typedCache[K, V]) Set(key K, value V, cost int64) bool {
+	return c.SetWithTTL(key, value, cost, 0*time.Second)
+}
+
+func (c *typedCache[K, V]) SetWithTTL(key K, value V, cost int64, ttl time.Duration) bool {
+	i, ok := c.newItem(key, value, cost, ttl)
+	if !ok {
 		return false
-	default:
-		expiration = time.Now().Add(ttl)
+	}
+	if c.l2 != nil {
+		c.l2.Del(i.hashKey, i.conflict)
 	}
 
-	hashKey, conflict := KeyToHash(key)
-	i := &item{
+	// 已存在则直接在 store 中更新，Set 返回后 Get 就能拿到新的值
+	// policy 中的 cost 还是需要交给 process 更新
+	if old, ok := c.store.Update(i.toStoreItem()); ok {
+		c.expiration.Update(i.hashKey, i.conflict, old.expiration, i.expiration)
+		i.flag = itemUpdate
+	} else {
+		i.flag = itemSet
+	}
+
+	return c.push(i)
+}
+
+func (c *typedCache[K, V]) GetTTL(key K) (time.Duration, bool) {
+	if c.isClosed() {
+		return 0, false
+	}
+
+	hashKey, conflict := c.hasher(key)
+	expiration, ok := c.store.Expiration(hashKey, conflict)
+	if !ok {
+		return 0, false
+	}
+	if expiration.IsZero() {
+		return 0, true
+	}
+	return clock.Until(c.clock, expiration), true
+}
+
+func (c *typedCache[K, V]) Touch(key K, ttl time.Duration) bool {
+	if c.isClosed() || ttl < 0 {
+		return false
+	}
+
+	expiration, sliding := c.expire(ttl)
+	hashKey, conflict := c.hasher(key)
+
+	// 和 SetWithTTL 一样直接在 store 和 expiration 中修改，cost 没变所以不需要经过 policy
+	old, ok := c.store.Touch(hashKey, conflict, expiration, sliding)
+	if !ok {
+		return false
+	}
+	c.expiration.Update(hashKey, conflict, old.expiration, expiration)
+	return true
+}
+
+// expire 根据 ttl 计算过期时间，开启了 OptionSlidingTTL 时还要返回滑动的时间
+func (c *typedCache[K, V]) expire(ttl time.Duration) (time.Time, time.Duration) {
+	// 没有过期时间，后期用 time.IsZero 判断即可
+	if ttl == 0 {
+		return time.Time{}, 0
+	}
+	if c.sliding {
+		return c.clock.Now().Add(ttl), ttl
+	}
+	return c.clock.Now().Add(ttl), 0
+}
+
+// newItem 校验参数并计算 hash 和过期时间
+func (c *typedCache[K, V]) newItem(key K, value V, cost int64, ttl time.Duration) (*item[V], bool) {
+	if cost == 0 {
+		return nil, false
+	}
+
+	if ttl < 0 {
+		return nil, false
+	}
+	expiration, sliding := c.expire(ttl)
+
+	hashKey, conflict := c.hasher(key)
+	i := &item[V]{
+		flag:       itemNew,
 		hashKey:    hashKey,
 		conflict:   conflict,
 		cost:       cost,
 		value:      value,
 		expiration: expiration,
+		sliding:    sliding,
+	}
+	if c.keepKeys {
+		i.key = key
+	}
+	return i, true
+}
+
+// push 非阻塞地丢入 addBuf
+func (c *typedCache[K, V]) push(i *item[V]) bool {
+	if c.isClosed() {
+		return false
 	}
 
 	select {
@@ -115,37 +515,517 @@ func (c *cache) AddWithTTL(key, value interface{}, cost int64, ttl time.Duration
 	default:
 	}
 
+	// 开启了 OptionBlockingAdd，再等一会
+	if c.addTimeout > 0 {
+		timer := c.clock.NewTimer(c.addTimeout)
+		defer timer.Stop()
+		select {
+		case c.addBuf <- i:
+			return true
+		case <-timer.C():
+		case <-c.stop:
+		}
+	}
+
+	// 已经在 store 中更新了，只是 policy 中的 cost 没有更新，所以还是算成功
+	if i.flag == itemUpdate {
+		return true
+	}
+
+	c.metrics.add(dropSets, i.hashKey, 1)
 	return false
 }
 
-func (c *cache) process() {
+// pushWait 阻塞地丢入 addBuf，直到关闭，用于 LoadSnapshot 这种一次加入很多、又不希望丢失的场景
+func (c *typedCache[K, V]) pushWait(i *item[V]) bool {
+	select {
+	case c.addBuf <- i:
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+func (c *typedCache[K, V]) Del(key K) {
+	if c.isClosed() {
+		return
+	}
+
+	hashKey, conflict := c.hasher(key)
+
+	// 立刻从 store 删除，这样 Del 返回后就 Get 不到了
+	if old, ok := c.store.Del(hashKey, conflict); ok {
+		c.expiration.Del(hashKey, old.expiration)
+	}
+	if c.l2 != nil {
+		c.l2.Del(hashKey, conflict)
+	}
+
+	// 这个 key 之前的 Add 可能还在 addBuf 中等待处理，所以也要丢入一个删除的 item，保证先加入后删除
+	// 必须阻塞，否则删除可能会丢失
+	select {
+	case c.addBuf <- &item[V]{
+		flag:     itemDelete,
+		hashKey:  hashKey,
+		conflict: conflict,
+	}:
+	case <-c.stop:
+	}
+}
+
+func (c *typedCache[K, V]) Clear() {
+	// 同样经过 addBuf，保证之前的操作都先处理完，之后的操作都在清空之后处理
+	c.barrier(itemClear)
+}
+
+func (c *typedCache[K, V]) Wait() {
+	c.barrier(itemWait)
+}
+
+// barrier 阻塞地丢入 addBuf，并等待 process 处理到它
+func (c *typedCache[K, V]) barrier(flag itemFlag) {
+	i := &item[V]{
+		flag: flag,
+		done: make(chan struct{}),
+	}
+	select {
+	case c.addBuf <- i:
+	case <-c.stop:
+		return
+	}
+
+	// 关闭时 process 可能还没处理到它就退出了
+	select {
+	case <-i.done:
+	case <-c.done:
+	}
+}
+
+func (c *typedCache[K, V]) Close() {
+	c.closeDo.Do(func() {
+		close(c.stop)
+		<-c.done
+		c.cleanupTicker.Stop()
+		c.policy.Close()
+		if c.l2 != nil {
+			_ = c.l2.Close()
+		}
+	})
+}
+
+func (c *typedCache[K, V]) isClosed() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *typedCache[K, V]) Frequency(key K) int {
+	hashKey, _ := c.hasher(key)
+	return c.policy.Frequency(hashKey)
+}
+
+func (c *typedCache[K, V]) Range(fn func(key K, value V, cost int64, expiration time.Time) bool) {
+	for shard := 0; shard < c.store.Shards(); shard++ {
+		items := c.store.Snapshot(shard)
+		for i := range items {
+			key, _ := items[i].key.(K)
+			if !fn(key, items[i].value, items[i].cost, items[i].expiration) {
+				return
+			}
+		}
+	}
+}
+
+// Scan cursor 就是下一个要遍历的分段
+func (c *typedCache[K, V]) Scan(cursor uint64, count int) ([]Entry[K, V], uint64) {
+	var entries []Entry[K, V]
+	for shard := int(cursor); shard < c.store.Shards(); shard++ {
+		items := c.store.Snapshot(shard)
+		for i := range items {
+			key, _ := items[i].key.(K)
+			entries = append(entries, Entry[K, V]{
+				Key:        key,
+				Value:      items[i].value,
+				Cost:       items[i].cost,
+				Expiration: items[i].expiration,
+			})
+		}
+		// 刚好是最后一个分段则返回 0
+		if len(entries) >= count && shard+1 < c.store.Shards() {
+			return entries, uint64(shard + 1)
+		}
+	}
+	return entries, 0
+}
+
+func (c *typedCache[K, V]) Metrics() *Metrics {
+	return c.metrics
+}
+
+func (c *typedCache[K, V]) process() {
+	defer close(c.done)
 	for {
 		select {
 		// 利用 chan 快速处理 add
 		case item := <-c.addBuf:
-			// 准入策略和淘汰策略
-			out, ok := c.policy.Add(item.hashKey, item.cost)
-			if ok {
-				c.store.Add(item.hashKey, item.conflict, item.value, item.expiration)
-			}
+			switch item.flag {
+			case itemNew:
+				c.processNew(item)
+
+			case itemSet:
+				out, ok := c.policy.Update(item.hashKey, item.cost)
+				if !ok {
+					c.processNew(item)
+					break
+				}
+				// 之前的 Add 已经加入了，覆盖
+				if old, ok := c.store.Update(item.toStoreItem()); ok {
+					c.expiration.Update(item.hashKey, item.conflict, old.expiration, item.expiration)
+				} else if c.store.Add(item.toStoreItem()) {
+					c.expiration.Add(item.hashKey, item.conflict, item.expiration)
+				}
+				c.metrics.add(keyUpdate, item.hashKey, 1)
+				c.delOut(out)
+
+			case itemUpdate:
+				// 已经被淘汰了（或者过期被删除了），那就当成新加入的
+				out, ok := c.policy.Update(item.hashKey, item.cost)
+				if !ok {
+					c.processNew(item)
+					break
+				}
+				c.metrics.add(keyUpdate, item.hashKey, 1)
+				c.delOut(out)
+
+			case itemDelete:
+				c.policy.Del(item.hashKey)
+				if old, ok := c.store.Del(item.hashKey, item.conflict); ok {
+					c.expiration.Del(item.hashKey, old.expiration)
+				}
+
+			case itemClear:
+				c.store.Clear()
+				c.policy.Clear()
+				c.expiration.Clear()
+				if c.l2 != nil {
+					_ = c.l2.Clear()
+				}
+				close(item.done)
 
-			// 从 store 中清除淘汰的
-			for i := 0; i < len(out); i++ {
-				c.store.Del(out[i], 0)
+			case itemWait:
+				close(item.done)
+
+			case itemExpire:
+				// 丢入 addBuf 之后可能又被 Set 重新加入了，此时不能删除
+				// 不能用 store.Get，它会延长滑动过期的时间，相当于过期清理自己让 key 一直不过期
+				if _, ok := c.store.Expiration(item.hashKey, item.conflict); ok {
+					break
+				}
+				c.policy.Del(item.hashKey)
+				c.expiration.Del(item.hashKey, item.expiration)
+				c.metrics.add(keyExpire, item.hashKey, 1)
 			}
 
 		// 定时删除过期 key
-		case <-c.cleanupTicker.C:
-			c.expiration.Clean(c.store, c.policy)
+		case <-c.cleanupTicker.C():
+			c.clean()
+
+		// 还在 addBuf 中的 item 直接丢弃
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// clean 根据 expiration 返回的已过期的 key 去 store 和 policy 中删除
+func (c *typedCache[K, V]) clean() {
+	var n uint64
+	for hashKey, conflict := range c.expiration.Clean() {
+		// 滑动过期的 key 被 Get 延长了，还没过期，重新放回时间轮
+		if expiration, ok := c.store.Expiration(hashKey, conflict); ok {
+			c.expiration.Add(hashKey, conflict, expiration)
+			continue
+		}
+		// 删除失败说明已经被 Get、Del 删除了（它们会从 policy 删除），或者 hashKey 已经是另一个 key（conflict 不同）的了，
+		// 此时 policy 中的也是那个 key 的，不能删除
+		if _, ok := c.store.Del(hashKey, conflict); ok {
+			c.policy.Del(hashKey)
+			n++
+		}
+	}
+	c.metrics.add(keyExpire, 0, n)
+
+	if c.l2 != nil {
+		c.l2.Clean()
+	}
+}
+
+// onExpire store.Get 发现过期并删除后调用，policy 和 expiration 交给 process 删除
+// 非阻塞，addBuf 满了就放弃，policy 中剩下的这个 key 之后会被当作淘汰的对象删除
+func (c *typedCache[K, V]) onExpire(old storeItem[V]) {
+	select {
+	case c.addBuf <- &item[V]{
+		flag:       itemExpire,
+		hashKey:    old.hashKey,
+		conflict:   old.conflict,
+		expiration: old.expiration,
+	}:
+	default:
+	}
+}
+
+func (c *typedCache[K, V]) processNew(item *item[V]) {
+	// 准入策略和淘汰策略，被淘汰的 key 和 cost 由 policy 统计
+	out, ok := c.policy.Add(item.hashKey, item.cost)
+	if ok {
+		// 只统计真正加入 store 的（同 ristretto），例如已经存在时 store.Add 会失败
+		if c.store.Add(item.toStoreItem()) {
+			c.expiration.Add(item.hashKey, item.conflict, item.expiration)
+			c.metrics.add(keyAdd, item.hashKey, 1)
+			c.metrics.add(costAdd, item.hashKey, uint64(item.cost))
 		}
+	} else {
+		c.metrics.add(rejectSets, item.hashKey, 1)
+	}
+
+	c.delOut(out)
+}
+
+// delOut 从 store 中清除淘汰的，开启了 OptionL2 时写入 L2
+func (c *typedCache[K, V]) delOut(out []uint64) {
+	for i := 0; i < len(out); i++ {
+		if old, ok := c.store.Del(out[i], 0); ok {
+			c.expiration.Del(out[i], old.expiration)
+			c.spill(old)
+		}
+	}
+}
+
+// spill 写入 L2，在 process 中同步写文件，写入失败（例如 value 比 L2 还大）就直接丢弃
+func (c *typedCache[K, V]) spill(old storeItem[V]) {
+	if c.l2 == nil {
+		return
+	}
+	// 马上就要过期了，没必要写入
+	if !old.expiration.IsZero() && !c.clock.Now().Before(old.expiration) {
+		return
+	}
+	b, err := c.l2Codec.Encode(old.value)
+	if err != nil {
+		return
+	}
+	_ = c.l2.Put(old.hashKey, old.conflict, b, old.cost, old.expiration, old.sliding)
+}
+
+// cache 非泛型版本，只是在 TypedCache 的基础上多了 nil 的检查
+type cache struct {
+	*typedCache[interface{}, interface{}]
+}
+
+func (c *cache) Get(key interface{}) (interface{}, bool) {
+	if key == nil {
+		return nil, false
+	}
+	return c.typedCache.Get(key)
+}
+
+func (c *cache) Peek(key interface{}) (interface{}, bool) {
+	if key == nil {
+		return nil, false
+	}
+	return c.typedCache.Peek(key)
+}
+
+func (c *cache) GetWithInfo(key interface{}) (interface{}, ItemInfo, bool) {
+	if key == nil {
+		return nil, ItemInfo{}, false
+	}
+	return c.typedCache.GetWithInfo(key)
+}
+
+func (c *cache) Add(key, value interface{}, cost int64) bool {
+	return c.AddWithTTL(key, value, cost, 0*time.Second)
+}
+
+func (c *cache) AddWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool {
+	if key == nil || value == nil {
+		return false
+	}
+	return c.typedCache.AddWithTTL(key, value, cost, ttl)
+}
+
+func (c *cache) Set(key, value interface{}, cost int64) bool {
+	return c.SetWithTTL(key, value, cost, 0*time.Second)
+}
+
+func (c *cache) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool {
+	if key == nil || value == nil {
+		return false
+	}
+	return c.typedCache.SetWithTTL(key, value, cost, ttl)
+}
+
+func (c *cache) GetTTL(key interface{}) (time.Duration, bool) {
+	if key == nil {
+		return 0, false
+	}
+	return c.typedCache.GetTTL(key)
+}
+
+func (c *cache) Touch(key interface{}, ttl time.Duration) bool {
+	if key == nil {
+		return false
+	}
+	return c.typedCache.Touch(key, ttl)
+}
+
+func (c *cache) Del(key interface{}) {
+	if key == nil {
+		return
+	}
+	c.typedCache.Del(key)
+}
+
+func (c *cache) Frequency(key interface{}) int {
+	if key == nil {
+		return 0
+	}
+	return c.typedCache.Frequency(key)
+}
+
+// config 所有的 option 都修改它，为什么不像以前一样直接修改 cache？因为 cache 改成泛型了，option 就也得跟着泛型
+type config struct {
+	metrics        bool
+	ringBufferSize int
+	addTimeout     time.Duration
+	newPolicy      NewPolicyFunc
+	ttlTick        time.Duration
+	sliding        bool
+	clock          clock.Clock
+	keepKeys       bool
+	stableHash     bool
+	l2Dir          string
+	l2MaxBytes     int64
+	// ValueCodec[V]，config 不是泛型的，创建时再检查类型，见 valueCodec
+	l2Codec interface{}
+	// 不为 nil 表示使用 slabStore，同样是 ValueCodec[V]
+	slabCodec interface{}
+	shards    int
+}
+
+// valueCodec 检查 option 传入的 ValueCodec 的类型是否和 value 一致
+func valueCodec[V any](codec interface{}) ValueCodec[V] {
+	c, ok := codec.(ValueCodec[V])
+	if !ok {
+		panic("ValueCodec does not match the value type")
+	}
+	return c
+}
+
+// Option 所有 OptionXxx 的类型，需要根据配置组合多个 option 时可以用 []Option
+type Option func(*config)
+
+// OptionMetrics 开启统计，通过 Cache.Metrics 获取。统计本身有一定开销，所以默认关闭
+func OptionMetrics() func(c *config) {
+	return func(c *config) {
+		c.metrics = true
+	}
+}
+
+// OptionBlockingAdd addBuf 满了时，加入缓存最多阻塞 timeout 再放弃，而不是直接丢弃
+// 适合写入量不大但不希望丢失的场景，会降低高并发下写入的速度
+func OptionBlockingAdd(timeout time.Duration) func(c *config) {
+	return func(c *config) {
+		c.addTimeout = timeout
+	}
+}
+
+// OptionPolicy 选择准入和淘汰策略，默认为 NewDefaultPolicy
+// 新 key 较多（突发）的场景可以用 NewWTinyLFUPolicy，扫描较多的场景可以用 NewS3FIFOPolicy 或 NewARCPolicy，
+// 只看最近访问、没有频率倾斜的场景可以用 NewLRUPolicy
+func OptionPolicy(newPolicy NewPolicyFunc) func(c *config) {
+	return func(c *config) {
+		c.newPolicy = newPolicy
+	}
+}
+
+// OptionTTLTick 过期时间的精度，也是定期清理的周期，默认 1 秒
+// 需要小于 1 秒的过期时间时调小，但定期清理会更频繁
+func OptionTTLTick(tick time.Duration) func(c *config) {
+	return func(c *config) {
+		c.ttlTick = tick
+	}
+}
+
+// OptionSlidingTTL 滑动过期，每次 Get 命中都把过期时间延长为 now + ttl（ttl 为加入时的过期时间），
+// 适合 session 之类一段时间不访问才过期的场景。没有过期时间的 key 不受影响
+func OptionSlidingTTL() func(c *config) {
+	return func(c *config) {
+		c.sliding = true
+	}
+}
+
+// OptionClock 替换获取当前时间的方式，过期判断、定期清理的定时器和 OptionBlockingAdd 的等待都使用它，默认为 clock.Real
+// 测试时传入 clock.NewFake，手动推进时间，不需要真的 sleep
+func OptionClock(clk clock.Clock) func(c *config) {
+	return func(c *config) {
+		c.clock = clk
+	}
+}
+
+// OptionKeepKeys 在 store 中保存原始的 key，这样 Range、Scan 才能拿到 key，用于查看、导出或迁移缓存
+// 默认只保存 key 的 hash，开启后每个 key 多占用一些内存
+func OptionKeepKeys() func(c *config) {
+	return func(c *config) {
+		c.keepKeys = true
+	}
+}
+
+// OptionStableHash string 和 []byte 类型的 key 使用 StableKeyToHash，hash 在重启后和不同节点之间都不会变
+// 默认的 memHash 每个进程的种子都不一样，而且依赖 runtime 内部的函数，新版本的 Go 可能不再支持
+func OptionStableHash() func(c *config) {
+	return func(c *config) {
+		c.stableHash = true
 	}
 }
 
-type optionFn func(*cache)
+// OptionL2 开启基于文件的 L2：从 L1 淘汰的 value 用 codec 编码后写入 dir 下的段文件，Get 在 L1 没有命中时再查 L2，
+// 命中则重新加入 L1。maxBytes 为 L2 文件的最大总字节数（包括每条记录的头部和还没回收的旧记录），超过时淘汰最早写入的
+// L2 的上限用字节而不是 cost：cost 由调用方定义，不一定和编码后的大小有关，而 L2 要限制的是磁盘空间。
+// L2 中的 key 仍然记录 L1 的 cost，重新加入 L1 时使用
+// V 需要和创建时的 value 类型一致，否则创建时 panic，dir 无法创建时也会 panic
+// L2 只在本进程内有效，启动时会删除 dir 下以前的段文件，Close 时也会删除。Peek、Range、Scan 和快照只包括 L1
+func OptionL2[V any](dir string, maxBytes int64, codec ValueCodec[V]) func(c *config) {
+	return func(c *config) {
+		c.l2Dir = dir
+		c.l2MaxBytes = maxBytes
+		c.l2Codec = codec
+	}
+}
+
+// OptionSlabStore value 用 codec 编码后存放在预先分配的大块字节数组（slab）中，而不是每个 key 一个指针
+// 适合 value 为字节（例如 ByteView）、key 有几百万个的场景，GC 不需要扫描每个 key，但每次 Get 都要解码（复制）value
+// V 需要和创建时的 value 类型一致，否则创建时 panic
+func OptionSlabStore[V any](codec ValueCodec[V]) func(c *config) {
+	return func(c *config) {
+		c.slabCodec = codec
+	}
+}
+
+// OptionShards store 的分段数量，默认为 GOMAXPROCS 的 16 倍。分段越多锁的争用越少，但每个分段都有一个 map 的开销
+// 不影响 OptionSlabStore
+func OptionShards(n int) func(c *config) {
+	return func(c *config) {
+		c.shards = n
+	}
+}
 
 // OptionRingBufferSize 建议 64
-func OptionRingBufferSize(cap int) func(c *cache) {
-	return func(c *cache) {
-		c.getBuf = newRingBufferPool(c.policy, cap)
+func OptionRingBufferSize(cap int) func(c *config) {
+	return func(c *config) {
+		c.ringBufferSize = cap
 	}
 }
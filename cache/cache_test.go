@@ -2,8 +2,11 @@ package cache
 
 import (
 	"fmt"
+	"runtime"
 	"testing"
 	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
 )
 
 func TestCache(t *testing.T) {
@@ -70,3 +73,594 @@ func TestCache(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func TestCache_Del(t *testing.T) {
+	c := NewCache(4*10, 4)
+
+	c.Add("ayang", "ayangValue", 1)
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := c.Get("ayang"); !ok {
+		t.Fatalf("Add failed")
+	}
+
+	c.Del("ayang")
+	if _, ok := c.Get("ayang"); ok {
+		t.Fatalf("Del failed")
+	}
+
+	// 删除后可以重新加入
+	c.Add("ayang", "ayangValue2", 1)
+	time.Sleep(10 * time.Millisecond)
+	if v, ok := c.Get("ayang"); !ok || v.(string) != "ayangValue2" {
+		t.Fatalf("Add after Del failed")
+	}
+}
+
+func TestCache_Frequency(t *testing.T) {
+	// 每次 Get 都立刻发送给 policy
+	c := NewCache(4*10*10, 4, OptionRingBufferSize(1))
+
+	// itemChan 满了会丢弃，所以每次 Get 后等一下
+	for _, key := range []string{"ayang", "ayang", "ayang", "tom"} {
+		c.Get(key)
+		time.Sleep(time.Millisecond)
+	}
+
+	if fre := c.Frequency("ayang"); fre != 3 {
+		t.Fatalf("ayang frequency should be 3, but %d", fre)
+	}
+	if fre := c.Frequency("tom"); fre != 1 {
+		t.Fatalf("tom frequency should be 1, but %d", fre)
+	}
+	if fre := c.Frequency("nocache"); fre != 0 {
+		t.Fatalf("nocache frequency should be 0, but %d", fre)
+	}
+}
+
+func TestCache_Set(t *testing.T) {
+	c := NewCache(4*10, 4, OptionMetrics())
+
+	c.Set("ayang", "ayangValue", 1)
+	c.Wait()
+
+	// 已存在，Add 不会覆盖，Set 会覆盖并且立刻生效
+	c.Add("ayang", "ayangValue2", 1)
+	c.Set("ayang", "ayangValue3", 3)
+	if v, ok := c.Get("ayang"); !ok || v.(string) != "ayangValue3" {
+		t.Fatalf("Set should overwrite")
+	}
+	c.Wait()
+	if v, ok := c.Get("ayang"); !ok || v.(string) != "ayangValue3" {
+		t.Fatalf("Add should not overwrite")
+	}
+	if c.Metrics().KeysUpdated() != 1 {
+		t.Fatalf("KeysUpdated should be 1")
+	}
+
+	// cost 从 1 变成了 3
+	c.Add("tom", "tomValue", 1)
+	c.Wait()
+	if used := c.(*cache).policy.(*defaultPolicy).used(); used != 4 {
+		t.Fatalf("used should be 4, but %d", used)
+	}
+
+	// cost 变大超出容量，淘汰 tom，不会淘汰自己
+	c.Set("ayang", "ayangValue4", 4)
+	c.Wait()
+	if _, ok := c.Get("tom"); ok {
+		t.Fatalf("tom should be evicted")
+	}
+	if v, ok := c.Get("ayang"); !ok || v.(string) != "ayangValue4" {
+		t.Fatalf("ayang should not be evicted")
+	}
+}
+
+func TestCache_DelOrder(t *testing.T) {
+	c := NewCache(4*10, 4)
+
+	// Add 还没有处理就 Del，也不会加入
+	c.Add("ayang", "ayangValue", 1)
+	c.Del("ayang")
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := c.Get("ayang"); ok {
+		t.Fatalf("Del should after Add")
+	}
+}
+
+func TestCache_Clear(t *testing.T) {
+	c := NewCache(4*10, 4, OptionRingBufferSize(1))
+
+	for i := 0; i < 4; i++ {
+		c.AddWithTTL(i, i, 1, time.Minute)
+	}
+	c.Get(100)
+	c.Clear()
+
+	for i := 0; i < 4; i++ {
+		if _, ok := c.Get(i); ok {
+			t.Fatalf("Clear failed")
+		}
+	}
+
+	// 空间也被清空了
+	for i := 4; i < 8; i++ {
+		c.Add(i, i, 1)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 4; i < 8; i++ {
+		if _, ok := c.Get(i); !ok {
+			t.Fatalf("Add after Clear failed")
+		}
+	}
+}
+
+func TestCache_SetAfterAdd(t *testing.T) {
+	c := NewCache(4*10, 4)
+
+	// Add 还没有处理就 Set，Set 也会覆盖
+	c.Add("ayang", "ayangValue", 1)
+	c.Set("ayang", "ayangValue2", 1)
+	c.Wait()
+	if v, ok := c.Get("ayang"); !ok || v.(string) != "ayangValue2" {
+		t.Fatalf("Set should overwrite Add")
+	}
+}
+
+func TestCache_Close(t *testing.T) {
+	before := runtime.NumGoroutine()
+	c := NewCache(4*10, 4)
+	c.Set("ayang", "ayangValue", 1)
+	time.Sleep(10 * time.Millisecond)
+
+	c.Close()
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("goroutine leak: before %d, after %d", before, n)
+	}
+
+	// 关闭后的调用不会阻塞，也不再生效
+	if _, ok := c.Get("ayang"); ok {
+		t.Fatalf("Get after close should fail")
+	}
+	if c.Set("tom", "tomValue", 1) {
+		t.Fatalf("Set after close should fail")
+	}
+	c.Del("ayang")
+	c.Clear()
+	c.Close()
+}
+
+func TestCache_Wait(t *testing.T) {
+	c := NewCache(4*10, 4)
+	defer c.Close()
+
+	// Wait 返回后一定能拿到
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		c.Add(key, i, 1)
+		c.Wait()
+		if v, ok := c.Get(key); !ok || v.(int) != i {
+			t.Fatalf("Get after Wait failed: %s", key)
+		}
+		c.Del(key)
+	}
+}
+
+func TestCache_BlockingAdd(t *testing.T) {
+	c := NewCache(4*10*addBufSize, addBufSize, OptionMetrics(), OptionBlockingAdd(time.Second)).(*cache)
+	defer c.Close()
+
+	// 远超 addBuf 的容量，阻塞等待也不会丢弃
+	for i := 0; i < 2*addBufSize; i++ {
+		if !c.Add(i, i, 1) {
+			t.Fatalf("Add should block instead of drop")
+		}
+	}
+	c.Wait()
+	if n := c.Metrics().SetsDropped(); n != 0 {
+		t.Fatalf("sets dropped: %d", n)
+	}
+}
+
+func TestNew(t *testing.T) {
+	c := New[string, int](4*10, 4)
+	defer c.Close()
+
+	c.Add("ayang", 1, 1)
+	c.Wait()
+	// 不需要类型断言
+	if v, ok := c.Get("ayang"); !ok || v != 1 {
+		t.Fatalf("Get failed")
+	}
+	if v, ok := c.Get("tom"); ok || v != 0 {
+		t.Fatalf("Get not exist should return zero value")
+	}
+
+	c.Del("ayang")
+	if _, ok := c.Get("ayang"); ok {
+		t.Fatalf("Del failed")
+	}
+}
+
+func TestNewWithHasher(t *testing.T) {
+	type point struct {
+		x, y int
+	}
+	hasher := func(p point) (uint64, uint64) {
+		return uint64(p.x)<<32 | uint64(p.y), 0
+	}
+	c := NewWithHasher[point, string](4*10, 4, hasher)
+	defer c.Close()
+
+	c.Set(point{1, 2}, "ayang", 1)
+	c.Wait()
+	if v, ok := c.Get(point{1, 2}); !ok || v != "ayang" {
+		t.Fatalf("Get failed")
+	}
+	if _, ok := c.Get(point{2, 1}); ok {
+		t.Fatalf("Get wrong key")
+	}
+}
+
+func TestCache_OptionPolicy(t *testing.T) {
+	for _, newPolicy := range []NewPolicyFunc{NewWTinyLFUPolicy, NewLRUPolicy, NewARCPolicy, NewS3FIFOPolicy} {
+		c := New[int, int](4*10, 4, OptionPolicy(newPolicy))
+
+		// 都共用 store，超过容量的被淘汰后 Get 不到
+		for i := 0; i < 8; i++ {
+			c.Add(i, i, 1)
+		}
+		c.Wait()
+		n := 0
+		for i := 0; i < 8; i++ {
+			if v, ok := c.Get(i); ok {
+				if v != i {
+					t.Fatalf("Get wrong value")
+				}
+				n++
+			}
+		}
+		if n != 4 {
+			t.Fatalf("should keep 4 keys, but %d", n)
+		}
+		c.Close()
+	}
+}
+
+func TestCache_LazyExpire(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	// tick 很大，不会定期清理，只能在 Get 时删除
+	c := NewCache(100, 10, OptionMetrics(), OptionClock(clk), OptionTTLTick(time.Hour))
+	defer c.Close()
+
+	c.AddWithTTL(1, 1, 1, 10*time.Millisecond)
+	c.Wait()
+	clk.Add(20 * time.Millisecond)
+
+	if _, ok := c.Get(1); ok {
+		t.Fatal("expired key is still visible")
+	}
+	c.Wait()
+	if n := c.Metrics().KeysExpired(); n != 1 {
+		t.Fatalf("KeysExpired = %d, want 1", n)
+	}
+	if tw := c.(*cache).expiration.(*timingWheel); len(tw.where) != 0 {
+		t.Fatalf("expiration still has %d keys", len(tw.where))
+	}
+}
+
+func TestCache_TTLTick(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := NewCache(100, 10, OptionMetrics(), OptionClock(clk), OptionTTLTick(10*time.Millisecond))
+	defer c.Close()
+
+	c.AddWithTTL(1, 1, 1, 20*time.Millisecond)
+	c.Wait()
+	clk.Add(100 * time.Millisecond)
+
+	// 定时器触发和 Wait 同时到达时 process 随机选一个处理，多等几次
+	for i := 0; i < 10 && c.Metrics().KeysExpired() == 0; i++ {
+		c.Wait()
+	}
+	if n := c.Metrics().KeysExpired(); n != 1 {
+		t.Fatalf("KeysExpired = %d, want 1", n)
+	}
+}
+
+func TestCache_SlidingTTL(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := NewCache(100, 10, OptionSlidingTTL(), OptionClock(clk), OptionTTLTick(10*time.Millisecond))
+	defer c.Close()
+
+	c.AddWithTTL(1, 1, 1, 50*time.Millisecond)
+	c.Wait()
+
+	// 一直在访问，总时间超过了 ttl 也不会过期
+	for i := 0; i < 6; i++ {
+		clk.Add(20 * time.Millisecond)
+		if _, ok := c.Get(1); !ok {
+			t.Fatalf("sliding key expired after %d gets", i)
+		}
+	}
+
+	clk.Add(100 * time.Millisecond)
+	if _, ok := c.Get(1); ok {
+		t.Fatal("sliding key should expire without access")
+	}
+}
+
+// TestCache_ExpireSliding 处理 itemExpire 时 key 还在（重新加入了），检查时不能延长滑动过期的时间
+func TestCache_ExpireSliding(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := New[int, int](100, 10, OptionSlidingTTL(), OptionClock(clk))
+	defer c.Close()
+
+	c.AddWithTTL(1, 1, 1, 50*time.Millisecond)
+	c.Wait()
+	clk.Add(20 * time.Millisecond)
+
+	tc := c.(*typedCache[int, int])
+	hashKey, conflict := tc.hasher(1)
+	tc.addBuf <- &item[int]{flag: itemExpire, hashKey: hashKey, conflict: conflict}
+	c.Wait()
+
+	if ttl, ok := c.GetTTL(1); !ok || ttl != 30*time.Millisecond {
+		t.Fatalf("GetTTL = %v, %v, want 30ms", ttl, ok)
+	}
+}
+
+// TestCache_CleanConflict 定期清理时 hashKey 已经是另一个 key 的了，不能从 policy 中删除
+func TestCache_CleanConflict(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	// a 和 b 的 hashKey 相同，conflict 不同
+	hasher := func(key string) (uint64, uint64) {
+		return 1, uint64(key[0])
+	}
+	c := NewWithHasher[string, int](100, 10, hasher, OptionClock(clk), OptionTTLTick(time.Minute))
+	defer c.Close()
+	tc := c.(*typedCache[string, int])
+
+	c.AddWithTTL("a", 1, 1, 20*time.Millisecond)
+	c.Wait()
+	// a 过期之后还没有清理，b 覆盖了 store 中的 a，policy 中的 hashKey 现在是 b 的
+	clk.Add(30 * time.Millisecond)
+	c.Set("b", 2, 1)
+	c.Wait()
+	if v, ok := c.Get("b"); !ok || v != 2 {
+		t.Fatalf("Get b = %v, %v", v, ok)
+	}
+
+	// 定时器触发和 Wait 同时到达时 process 随机选一个处理，多等几次
+	clk.Add(2 * time.Minute)
+	for i := 0; i < 10; i++ {
+		c.Wait()
+	}
+	if used := tc.policy.(*defaultPolicy).used(); used != 1 {
+		t.Fatalf("used = %d, want 1", used)
+	}
+	if v, ok := c.Get("b"); !ok || v != 2 {
+		t.Fatalf("Get b after clean = %v, %v", v, ok)
+	}
+}
+
+func TestCache_GetTTL_Touch(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := NewCache(100, 10, OptionClock(clk))
+	defer c.Close()
+
+	if _, ok := c.GetTTL(1); ok {
+		t.Fatal("GetTTL should fail when not exist")
+	}
+	if c.Touch(1, time.Minute) {
+		t.Fatal("Touch should fail when not exist")
+	}
+
+	c.Add(1, 1, 1)
+	c.Wait()
+	if ttl, ok := c.GetTTL(1); !ok || ttl != 0 {
+		t.Fatalf("GetTTL = %v, %v, want 0, true", ttl, ok)
+	}
+
+	if !c.Touch(1, time.Minute) {
+		t.Fatal("Touch failed")
+	}
+	clk.Add(time.Second)
+	if ttl, ok := c.GetTTL(1); !ok || ttl != 59*time.Second {
+		t.Fatalf("GetTTL = %v, %v, want 59s", ttl, ok)
+	}
+
+	c.Touch(1, 10*time.Millisecond)
+	clk.Add(20 * time.Millisecond)
+	if _, ok := c.Get(1); ok {
+		t.Fatal("key should expire after Touch")
+	}
+}
+
+func TestCache_Peek(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := NewCache(4*10*10, 4, OptionRingBufferSize(1), OptionSlidingTTL(), OptionClock(clk))
+	defer c.Close()
+
+	c.AddWithTTL("ayang", 1, 1, time.Minute)
+	c.Wait()
+
+	for i := 0; i < 3; i++ {
+		if v, ok := c.Peek("ayang"); !ok || v.(int) != 1 {
+			t.Fatalf("Peek = %v, %v", v, ok)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if fre := c.Frequency("ayang"); fre != 0 {
+		t.Fatalf("Peek should not increase frequency, but %d", fre)
+	}
+
+	// 也不会延长滑动过期时间
+	clk.Add(30 * time.Second)
+	c.Peek("ayang")
+	if ttl, _ := c.GetTTL("ayang"); ttl != 30*time.Second {
+		t.Fatalf("Peek should not extend sliding ttl, but %v", ttl)
+	}
+}
+
+func TestCache_GetWithInfo(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := NewCache(4*10*10, 4, OptionRingBufferSize(1), OptionClock(clk))
+	defer c.Close()
+
+	created := clk.Now()
+	c.AddWithTTL("ayang", 1, 2, time.Minute)
+	c.Wait()
+	clk.Add(time.Second)
+	c.Set("ayang", 2, 3)
+	c.Wait()
+
+	v, info, ok := c.GetWithInfo("ayang")
+	if !ok || v.(int) != 2 {
+		t.Fatalf("GetWithInfo = %v, %v", v, ok)
+	}
+	if info.Cost != 3 || !info.Created.Equal(created) || !info.Expiration.IsZero() {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	// 不在缓存中也返回频率
+	for i := 0; i < 2; i++ {
+		c.Get("tom")
+		time.Sleep(time.Millisecond)
+	}
+	// GetWithInfo 本身也算一次 Get，但是异步增加的，可能还没算上
+	if _, info, ok = c.GetWithInfo("tom"); ok || info.Frequency < 2 {
+		t.Fatalf("GetWithInfo(tom) = %+v, %v", info, ok)
+	}
+}
+
+// TestCache_GetWithInfo_Consistent 并发 Set 时，GetWithInfo 返回的 value 和 cost 来自同一个 item
+func TestCache_GetWithInfo_Consistent(t *testing.T) {
+	c := New[int, int](1000, 1000)
+	defer c.Close()
+	c.Set(1, 1, 1)
+	c.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 10000; i++ {
+			c.Set(1, i%100+1, int64(i%100+1))
+		}
+	}()
+	for i := 0; i < 10000; i++ {
+		if v, info, ok := c.GetWithInfo(1); ok && int64(v) != info.Cost {
+			t.Fatalf("value %d but cost %d", v, info.Cost)
+		}
+	}
+	<-done
+}
+
+// TestCache_GetWithInfo_Sliding 返回的是滑动过期延长之后的过期时间
+func TestCache_GetWithInfo_Sliding(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := New[int, int](100, 10, OptionSlidingTTL(), OptionClock(clk))
+	defer c.Close()
+
+	c.AddWithTTL(1, 1, 1, time.Minute)
+	c.Wait()
+	clk.Add(time.Second)
+	if _, info, ok := c.GetWithInfo(1); !ok || !info.Expiration.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("GetWithInfo = %+v, %v", info, ok)
+	}
+}
+
+func TestCache_Range_Scan(t *testing.T) {
+	// 分段数量默认和 GOMAXPROCS 有关，固定下来，每页才能只有几个分段
+	c := New[int, int](10000, 1000, OptionKeepKeys(), OptionShards(256))
+	defer c.Close()
+
+	for i := 0; i < 500; i++ {
+		c.Add(i, i*10, 1)
+	}
+	c.Wait()
+
+	n := 0
+	c.Range(func(key int, value int, cost int64, _ time.Time) bool {
+		if value != key*10 || cost != 1 {
+			t.Fatalf("Range key %d value %d cost %d", key, value, cost)
+		}
+		n++
+		return true
+	})
+	if n != 500 {
+		t.Fatalf("Range visited %d keys, want 500", n)
+	}
+
+	// 提前停止
+	n = 0
+	c.Range(func(int, int, int64, time.Time) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("Range should stop after 10, but %d", n)
+	}
+
+	seen := make(map[int]bool)
+	var cursor uint64
+	pages := 0
+	for {
+		entries, next := c.Scan(cursor, 100)
+		for _, e := range entries {
+			seen[e.Key] = true
+		}
+		pages++
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != 500 || pages < 5 {
+		t.Fatalf("Scan got %d keys in %d pages", len(seen), pages)
+	}
+}
+
+func TestCache_Shards(t *testing.T) {
+	c := New[int, int](100, 10, OptionShards(3))
+	defer c.Close()
+	if n := c.(*typedCache[int, int]).store.Shards(); n != 3 {
+		t.Fatalf("Shards = %d, want 3", n)
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	for i := 0; i < 10; i++ {
+		if v, ok := c.Get(i); !ok || v != i {
+			t.Fatalf("Get %d = %d, %v", i, v, ok)
+		}
+	}
+
+	c2 := New[int, int](100, 10)
+	defer c2.Close()
+	if n := c2.(*typedCache[int, int]).store.Shards(); n != runtime.GOMAXPROCS(0)*shardsPerProc {
+		t.Fatalf("default Shards = %d", n)
+	}
+}
+
+// BenchmarkCache_Get 整个 Get 的路径（包括 getBuf），用 -cpu 对比不同的并发
+func BenchmarkCache_Get(b *testing.B) {
+	for _, shards := range benchmarkShards(16, 256) {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := New[int, int](1<<20, 1<<16, OptionShards(shards))
+			defer c.Close()
+			for i := 0; i < 1<<16; i++ {
+				c.Set(i, i, 1)
+			}
+			c.Wait()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					c.Get(i & (1<<16 - 1))
+					i++
+				}
+			})
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"encoding/binary"
 	"github.com/cespare/xxhash/v2"
 	"unsafe"
 )
@@ -54,3 +55,108 @@ func KeyToHash(key interface{}) (uint64, uint64) {
 		panic("Key type not supported")
 	}
 }
+
+const (
+	// StableKeyToHash 的两个种子，固定不变，改了之后以前保存的 hash 就都对不上了
+	stableSeed         uint64 = 0x9e3779b97f4a7c15
+	stableConflictSeed uint64 = 0xc2b2ae3d27d4eb4f
+)
+
+// StableKeyToHash 同 KeyToHash，但 string 和 []byte 只用固定种子的 xxhash，不依赖 runtime.memhash
+// 同一个 key 在不同的进程、不同的节点上 hash 都一样，适合需要持久化 hash、跨节点比较或者测试需要结果可复现的场景
+// 比 memHash 慢一些，见 OptionStableHash
+func StableKeyToHash(key interface{}) (uint64, uint64) {
+	switch k := key.(type) {
+	case string:
+		return seededHashString(stableSeed, k), seededHashString(stableConflictSeed, k)
+	case []byte:
+		return seededHash(stableSeed, k), seededHash(stableConflictSeed, k)
+	default:
+		// 整数本身就是稳定的
+		return KeyToHash(key)
+	}
+}
+
+// seededHash 当前版本的 xxhash 不能指定种子，在数据前面加上 8 个字节的种子，效果相同
+func seededHash(seed uint64, data []byte) uint64 {
+	var d xxhash.Digest
+	d.Reset()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], seed)
+	_, _ = d.Write(b[:])
+	_, _ = d.Write(data)
+	return d.Sum64()
+}
+
+func seededHashString(seed uint64, data string) uint64 {
+	var d xxhash.Digest
+	d.Reset()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], seed)
+	_, _ = d.Write(b[:])
+	_, _ = d.WriteString(data)
+	return d.Sum64()
+}
+
+// Key New 支持的 key 类型，编译期就能检查，不会像 KeyToHash 一样在运行时 panic
+// 注意：不支持以它们为底层类型的自定义类型（例如 type UserID string），这种需要用 NewWithHasher
+type Key interface {
+	uint64 | string | byte | int | int32 | uint32 | int64
+}
+
+// Hasher 同 KeyToHash，返回两个不同 hash 函数的结果，第二个用于判断 hash 冲突，可以为 0
+// 结构体等 Key 不支持的类型需要自己提供，见 NewWithHasher
+type Hasher[K any] func(key K) (uint64, uint64)
+
+// defaultHasher NewCache 和 New 使用的 hash 函数，开启 OptionStableHash 时使用 StableKeyToHash
+// 创建时根据 K 的类型选择一次，string、[]byte 和整数直接调用对应的 hash，Get、Set 时不需要把 key 转成 interface{}，
+// 也不需要类型判断。只有 NewCache（K 为 interface{}）才走 KeyToHash
+func defaultHasher[K any](stable bool) Hasher[K] {
+	var h interface{}
+	switch any(*new(K)).(type) {
+	case string:
+		if stable {
+			h = func(key string) (uint64, uint64) {
+				return seededHashString(stableSeed, key), seededHashString(stableConflictSeed, key)
+			}
+		} else {
+			h = func(key string) (uint64, uint64) {
+				return memHashString(key), xxhash.Sum64String(key)
+			}
+		}
+	case []byte:
+		if stable {
+			h = func(key []byte) (uint64, uint64) {
+				return seededHash(stableSeed, key), seededHash(stableConflictSeed, key)
+			}
+		} else {
+			h = func(key []byte) (uint64, uint64) {
+				return memHash(key), xxhash.Sum64(key)
+			}
+		}
+	// 整数本身就是稳定的，和 KeyToHash 一样直接作为 hash
+	case uint64:
+		h = func(key uint64) (uint64, uint64) { return key, 0 }
+	case byte:
+		h = func(key byte) (uint64, uint64) { return uint64(key), 0 }
+	case int:
+		h = func(key int) (uint64, uint64) { return uint64(key), 0 }
+	case int32:
+		h = func(key int32) (uint64, uint64) { return uint64(key), 0 }
+	case uint32:
+		h = func(key uint32) (uint64, uint64) { return uint64(key), 0 }
+	case int64:
+		h = func(key int64) (uint64, uint64) { return uint64(key), 0 }
+	default:
+		if stable {
+			return func(key K) (uint64, uint64) {
+				return StableKeyToHash(key)
+			}
+		}
+		return func(key K) (uint64, uint64) {
+			return KeyToHash(key)
+		}
+	}
+	// K 就是 case 中的类型，所以断言一定成功
+	return h.(func(key K) (uint64, uint64))
+}
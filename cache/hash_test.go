@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestStableKeyToHash 结果写死在这里，改了种子或者算法这个测试就会失败，提醒以前保存的 hash 都对不上了
+func TestStableKeyToHash(t *testing.T) {
+	hashKey, conflict := StableKeyToHash("ayang")
+	if hashKey != 0x8315ebb1866141f9 || conflict != 0xe0c36898c1c58631 {
+		t.Fatalf("StableKeyToHash(ayang) = %#x, %#x", hashKey, conflict)
+	}
+	if h, c := StableKeyToHash([]byte("ayang")); h != hashKey || c != conflict {
+		t.Fatalf("string and []byte should have the same hash")
+	}
+	if h, c := StableKeyToHash(uint64(7)); h != 7 || c != 0 {
+		t.Fatalf("StableKeyToHash(7) = %d, %d", h, c)
+	}
+
+	c := New[string, int](100, 10, OptionStableHash())
+	defer c.Close()
+	if h, _ := c.(*typedCache[string, int]).hasher("ayang"); h != hashKey {
+		t.Fatalf("OptionStableHash should use StableKeyToHash")
+	}
+	c.Add("ayang", 1, 1)
+	c.Wait()
+	if v, ok := c.Get("ayang"); !ok || v != 1 {
+		t.Fatalf("Get = %v, %v", v, ok)
+	}
+}
+
+// TestDefaultHasher 按类型选择的 hash 函数和 KeyToHash、StableKeyToHash 的结果一致
+func TestDefaultHasher(t *testing.T) {
+	for _, stable := range []bool{false, true} {
+		keyToHash := KeyToHash
+		if stable {
+			keyToHash = StableKeyToHash
+		}
+		check := func(name string, got [2]uint64, key interface{}) {
+			h, c := keyToHash(key)
+			if got != [2]uint64{h, c} {
+				t.Fatalf("stable %v %s: hasher = %#x, want %#x, %#x", stable, name, got, h, c)
+			}
+		}
+		hash := func(h, c uint64) [2]uint64 {
+			return [2]uint64{h, c}
+		}
+
+		check("string", hash(defaultHasher[string](stable)("ayang")), "ayang")
+		check("[]byte", hash(defaultHasher[[]byte](stable)([]byte("ayang"))), []byte("ayang"))
+		check("uint64", hash(defaultHasher[uint64](stable)(7)), uint64(7))
+		check("byte", hash(defaultHasher[byte](stable)(7)), byte(7))
+		check("int", hash(defaultHasher[int](stable)(-7)), -7)
+		check("int32", hash(defaultHasher[int32](stable)(7)), int32(7))
+		check("uint32", hash(defaultHasher[uint32](stable)(7)), uint32(7))
+		check("int64", hash(defaultHasher[int64](stable)(7)), int64(7))
+		check("interface{}", hash(defaultHasher[interface{}](stable)("ayang")), "ayang")
+	}
+}
+
+// BenchmarkCache_GetString string key 的 Get 不应该有内存分配（key 不会被转成 interface{}）
+func BenchmarkCache_GetString(b *testing.B) {
+	c := New[string, int](1<<12, 1<<10)
+	defer c.Close()
+	keys := make([]string, 1<<10)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		c.Set(keys[i], i, 1)
+	}
+	c.Wait()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Get(keys[i&(1<<10-1)])
+	}
+}
@@ -0,0 +1,452 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
+)
+
+const (
+	// l2Segments maxBytes 大约分成多少个段文件，淘汰和压缩都以段为单位
+	l2Segments = 8
+	// l2HeaderSize 每条记录的头部：hashKey、conflict、value 的长度、crc32
+	l2HeaderSize = 8 + 8 + 4 + 4
+	// l2FileExt 段文件的后缀，启动时会删除目录下所有这个后缀的文件
+	l2FileExt = ".l2"
+)
+
+var (
+	errL2TooLarge = errors.New("value is larger than L2 max bytes")
+	errL2Corrupt  = errors.New("L2 record is corrupt")
+)
+
+// l2Entry 索引，记录的位置和 L1 中的元信息
+type l2Entry struct {
+	conflict uint64
+	seg      *l2Segment
+	offset   int64
+	// 整条记录的长度
+	size       int64
+	cost       int64
+	expiration time.Time
+	sliding    time.Duration
+}
+
+// l2Segment 一个只追加的段文件
+type l2Segment struct {
+	id   uint64
+	file *os.File
+	// 文件的大小
+	size int64
+	// 还在索引中的记录的大小，size - live 就是可以回收的空间
+	live int64
+	// 还在索引中的 key，淘汰或压缩这个段时使用
+	keys map[uint64]struct{}
+}
+
+// fileStore L2，存放从 L1 淘汰的 value，用本地磁盘换内存
+// 日志结构（同 bitcask）：写入只追加到最新的段文件，内存中的索引记录每个 key 最新的位置，更新和删除只修改索引
+// 总大小超过 maxBytes 时处理最旧的段：有效数据少于一半就把有效的记录复制到最新的段（压缩），否则整个段淘汰（FIFO），然后删除文件
+// 读写文件时不持有 mutex，只在前后加锁修改索引，这样一个 key 的读写不会阻塞其他 key；写入（Put 和压缩）由 writeMu 串行
+// 索引只在内存中，而且默认的 hash 每个进程都不一样，所以不会在重启后复用以前的文件
+type fileStore struct {
+	// writeMu 同一时间只有一个写入，持有 writeMu 时才能修改段文件和 nextID，先 writeMu 后 mutex
+	writeMu sync.Mutex
+	// mutex 保护索引和段的元信息
+	mutex    sync.Mutex
+	dir      string
+	clock    clock.Clock
+	metrics  *Metrics
+	maxBytes int64
+	// 最新的段超过这个大小就换一个新的
+	segBytes int64
+	// 所有段文件的总大小
+	total int64
+	index map[uint64]*l2Entry
+	// 有过期时间的 key，Clean 只处理到期的，不用遍历整个索引
+	expiration *timingWheel
+	// 从旧到新，最后一个是正在写入的
+	segments []*l2Segment
+	nextID   uint64
+	// Put 正在写文件（没有持有 mutex）的 key，期间被 Del 了就不再加入索引，否则会把删除的值又加回来
+	writing  bool
+	pending  uint64
+	canceled bool
+}
+
+// newFileStore 创建 dir，并删除 dir 下以前留下的段文件，tick 为过期时间的精度，同 L1 的时间轮
+func newFileStore(dir string, maxBytes int64, clk clock.Clock, tick time.Duration, metrics *Metrics) (*fileStore, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("L2 max bytes must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := removeSegmentFiles(dir); err != nil {
+		return nil, err
+	}
+
+	segBytes := maxBytes / l2Segments
+	if segBytes == 0 {
+		segBytes = 1
+	}
+	return &fileStore{
+		dir:        dir,
+		clock:      clk,
+		metrics:    metrics,
+		maxBytes:   maxBytes,
+		segBytes:   segBytes,
+		index:      make(map[uint64]*l2Entry),
+		expiration: newTimingWheel(clk, tick),
+	}, nil
+}
+
+func removeSegmentFiles(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+l2FileExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put 写入 value，已存在则覆盖
+func (s *fileStore) Put(hashKey, conflict uint64, value []byte, cost int64, expiration time.Time, sliding time.Duration) error {
+	size := int64(l2HeaderSize + len(value))
+	if size > s.maxBytes {
+		return errL2TooLarge
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	// 旧的值马上就不能再读到了
+	s.mutex.Lock()
+	s.del(hashKey)
+	s.writing, s.pending, s.canceled = true, hashKey, false
+	s.mutex.Unlock()
+
+	seg, offset, err := s.write(encodeL2Record(hashKey, conflict, value))
+
+	s.mutex.Lock()
+	canceled := s.canceled
+	s.writing = false
+	if err == nil && !canceled {
+		s.link(hashKey, seg, offset, &l2Entry{
+			conflict:   conflict,
+			size:       size,
+			cost:       cost,
+			expiration: expiration,
+			sliding:    sliding,
+		})
+		s.expiration.Add(hashKey, conflict, expiration)
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if !canceled {
+		s.metrics.add(l2KeyAdd, hashKey, 1)
+	}
+
+	return s.shrink()
+}
+
+// write 把 record 追加到最新的段，返回写入的段和位置，调用方需要持有 writeMu
+// 只在分配位置时加锁，写文件时不加锁。写入失败时这段空间就浪费了，等这个段被压缩或淘汰时回收
+func (s *fileStore) write(record []byte) (*l2Segment, int64, error) {
+	seg, err := s.active()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.mutex.Lock()
+	offset := seg.size
+	seg.size += int64(len(record))
+	s.total += int64(len(record))
+	s.mutex.Unlock()
+
+	if _, err = seg.file.WriteAt(record, offset); err != nil {
+		return nil, 0, err
+	}
+	return seg, offset, nil
+}
+
+// link 把写好的记录加入索引，调用方需要上锁
+func (s *fileStore) link(hashKey uint64, seg *l2Segment, offset int64, e *l2Entry) {
+	e.seg = seg
+	e.offset = offset
+	s.index[hashKey] = e
+	seg.live += e.size
+	seg.keys[hashKey] = struct{}{}
+}
+
+// active 返回正在写入的段，满了就新建一个，调用方需要持有 writeMu
+func (s *fileStore) active() (*l2Segment, error) {
+	s.mutex.Lock()
+	if n := len(s.segments); n > 0 && s.segments[n-1].size < s.segBytes {
+		seg := s.segments[n-1]
+		s.mutex.Unlock()
+		return seg, nil
+	}
+	s.mutex.Unlock()
+
+	s.nextID++
+	name := filepath.Join(s.dir, fmt.Sprintf("%08d%s", s.nextID, l2FileExt))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &l2Segment{
+		id:   s.nextID,
+		file: file,
+		keys: make(map[uint64]struct{}),
+	}
+
+	s.mutex.Lock()
+	s.segments = append(s.segments, seg)
+	s.mutex.Unlock()
+	return seg, nil
+}
+
+// shrink 超过 maxBytes 时压缩或淘汰最旧的段，正在写入的段不处理，调用方需要持有 writeMu
+func (s *fileStore) shrink() error {
+	for {
+		s.mutex.Lock()
+		if s.total <= s.maxBytes || len(s.segments) <= 1 {
+			s.mutex.Unlock()
+			return nil
+		}
+		oldest := s.segments[0]
+		s.segments = s.segments[1:]
+		// 有效数据不多，复制到最新的段，只会复制这一次，所以每次至少回收一半
+		compact := oldest.live*2 < oldest.size
+		var moves []uint64
+		if compact {
+			moves = make([]uint64, 0, len(oldest.keys))
+			for hashKey := range oldest.keys {
+				moves = append(moves, hashKey)
+			}
+		}
+		s.mutex.Unlock()
+
+		for _, hashKey := range moves {
+			s.move(hashKey, oldest)
+		}
+
+		// 剩下的是整个淘汰的，或者复制失败的
+		s.mutex.Lock()
+		for hashKey := range oldest.keys {
+			s.del(hashKey)
+			if !compact {
+				s.metrics.add(l2KeyEvict, hashKey, 1)
+			}
+		}
+		s.total -= oldest.size
+		s.mutex.Unlock()
+
+		// 此时可能还有 Get 在读这个段，它们会读取失败，当作没有命中
+		if err := closeSegment(oldest); err != nil {
+			return err
+		}
+	}
+}
+
+// move 把 hashKey 的记录从 seg 复制到最新的段，调用方需要持有 writeMu
+// 复制期间 key 可能被删除了，此时不再加入索引
+func (s *fileStore) move(hashKey uint64, seg *l2Segment) {
+	s.mutex.Lock()
+	e, ok := s.index[hashKey]
+	if !ok || e.seg != seg {
+		s.mutex.Unlock()
+		return
+	}
+	offset, size := e.offset, e.size
+	s.mutex.Unlock()
+
+	record := make([]byte, size)
+	if _, err := seg.file.ReadAt(record, offset); err != nil {
+		return
+	}
+	newSeg, newOffset, err := s.write(record)
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.index[hashKey] == e && e.seg == seg {
+		seg.live -= e.size
+		delete(seg.keys, hashKey)
+		s.link(hashKey, newSeg, newOffset, e)
+	}
+	s.mutex.Unlock()
+}
+
+// Get 返回 value 和加入 L1 时的 cost、过期时间，过期的直接删除
+func (s *fileStore) Get(hashKey, conflict uint64) ([]byte, *l2Entry, bool) {
+	s.mutex.Lock()
+	e, ok := s.index[hashKey]
+	if !ok || (conflict != 0 && e.conflict != conflict) {
+		s.mutex.Unlock()
+		return nil, nil, false
+	}
+	if !e.expiration.IsZero() && !s.clock.Now().Before(e.expiration) {
+		s.del(hashKey)
+		s.mutex.Unlock()
+		return nil, nil, false
+	}
+	seg, offset := e.seg, e.offset
+	record := make([]byte, e.size)
+	s.mutex.Unlock()
+
+	_, err := seg.file.ReadAt(record, offset)
+	var value []byte
+	if err == nil {
+		value, err = decodeL2Record(hashKey, record)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// 读文件时没有加锁，期间可能被删除或者覆盖了
+	if s.index[hashKey] != e {
+		return nil, nil, false
+	}
+	if err != nil {
+		// 被压缩移动到了别的段，旧的段已经关闭了，记录本身没有问题
+		if e.seg == seg {
+			s.del(hashKey)
+		}
+		return nil, nil, false
+	}
+
+	if e.sliding > 0 {
+		e.expiration = s.clock.Now().Add(e.sliding)
+	}
+	// 返回副本，调用方修改不会影响索引
+	info := *e
+	return value, &info, true
+}
+
+// Del conflict 为 0 时不检查冲突
+func (s *fileStore) Del(hashKey, conflict uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.writing && s.pending == hashKey {
+		s.canceled = true
+	}
+	if e, ok := s.index[hashKey]; ok && (conflict == 0 || e.conflict == conflict) {
+		s.del(hashKey)
+	}
+}
+
+// del 只从索引中删除，空间在压缩或淘汰这个段时回收，调用方需要上锁
+func (s *fileStore) del(hashKey uint64) {
+	e, ok := s.index[hashKey]
+	if !ok {
+		return
+	}
+	delete(s.index, hashKey)
+	e.seg.live -= e.size
+	delete(e.seg.keys, hashKey)
+	s.expiration.Del(hashKey, e.expiration)
+}
+
+// Clean 删除已过期的 key，返回删除的数量
+// 由时间轮返回到期的 key，只处理这些，不用遍历整个索引；滑动过期的被 Get 延长了，重新放回时间轮
+func (s *fileStore) Clean() int {
+	expired := s.expiration.Clean()
+	if len(expired) == 0 {
+		return 0
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	n := 0
+	for hashKey, conflict := range expired {
+		e, ok := s.index[hashKey]
+		if !ok || e.conflict != conflict || e.expiration.IsZero() {
+			continue
+		}
+		if now.Before(e.expiration) {
+			s.expiration.Add(hashKey, conflict, e.expiration)
+			continue
+		}
+		s.del(hashKey)
+		n++
+	}
+	return n
+}
+
+// Clear 删除所有的 key 和段文件，会等待正在进行的写入
+func (s *fileStore) Clear() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reset()
+}
+
+// Close 同 Clear，之后不能再使用
+func (s *fileStore) Close() error {
+	return s.Clear()
+}
+
+// reset 调用方需要上锁
+func (s *fileStore) reset() error {
+	var err error
+	for _, seg := range s.segments {
+		if closeErr := closeSegment(seg); err == nil {
+			err = closeErr
+		}
+	}
+	s.segments = nil
+	s.index = make(map[uint64]*l2Entry)
+	s.expiration.Clear()
+	s.total = 0
+	return err
+}
+
+func closeSegment(seg *l2Segment) error {
+	if err := seg.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(seg.file.Name())
+}
+
+func encodeL2Record(hashKey, conflict uint64, value []byte) []byte {
+	record := make([]byte, l2HeaderSize+len(value))
+	binary.BigEndian.PutUint64(record[0:], hashKey)
+	binary.BigEndian.PutUint64(record[8:], conflict)
+	binary.BigEndian.PutUint32(record[16:], uint32(len(value)))
+	copy(record[l2HeaderSize:], value)
+	binary.BigEndian.PutUint32(record[20:], crc32.ChecksumIEEE(record[l2HeaderSize:]))
+	return record
+}
+
+// decodeL2Record 检查 hashKey 和 crc，防止索引错乱或者文件被外部修改
+func decodeL2Record(hashKey uint64, record []byte) ([]byte, error) {
+	if len(record) < l2HeaderSize || binary.BigEndian.Uint64(record[0:]) != hashKey {
+		return nil, errL2Corrupt
+	}
+	n := int(binary.BigEndian.Uint32(record[16:]))
+	value := record[l2HeaderSize:]
+	if n != len(value) || binary.BigEndian.Uint32(record[20:]) != crc32.ChecksumIEEE(value) {
+		return nil, errL2Corrupt
+	}
+	return value, nil
+}
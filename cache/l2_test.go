@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
+)
+
+func TestFileStore(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	dir := t.TempDir()
+	// 以前留下的段文件会被删除
+	if err := os.WriteFile(filepath.Join(dir, "00000001"+l2FileExt), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFileStore(dir, 1<<20, clk, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.total != 0 {
+		t.Fatalf("total = %d, want 0", s.total)
+	}
+
+	if err = s.Put(1, 11, []byte("ayang"), 5, time.Time{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(2, 22, []byte("tom"), 3, clk.Now().Add(time.Second), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(3, 33, []byte("jerry"), 5, clk.Now().Add(time.Second), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	v, e, ok := s.Get(1, 11)
+	if !ok || string(v) != "ayang" || e.cost != 5 {
+		t.Fatalf("Get 1 = %s, %v", v, ok)
+	}
+	if _, _, ok = s.Get(1, 12); ok {
+		t.Fatalf("conflict should not match")
+	}
+
+	// 覆盖
+	if err = s.Put(1, 11, []byte("ayang2"), 6, time.Time{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ = s.Get(1, 11); string(v) != "ayang2" {
+		t.Fatalf("Get after overwrite = %s", v)
+	}
+
+	// 滑动过期的被 Get 延长了
+	if _, _, ok = s.Get(3, 33); !ok {
+		t.Fatalf("Get 3 failed")
+	}
+	clk.Add(2 * time.Second)
+	if _, _, ok = s.Get(2, 22); ok {
+		t.Fatalf("2 should be expired")
+	}
+	if n := s.Clean(); n != 0 {
+		t.Fatalf("Clean = %d, want 0", n)
+	}
+	if _, _, ok = s.Get(3, 33); !ok {
+		t.Fatalf("3 should not be expired")
+	}
+
+	s.Del(1, 0)
+	if _, _, ok = s.Get(1, 11); ok {
+		t.Fatalf("Get after Del should fail")
+	}
+
+	if err = s.Put(4, 44, make([]byte, 1<<20), 1, time.Time{}, 0); err != errL2TooLarge {
+		t.Fatalf("Put too large err = %v", err)
+	}
+
+	if err = s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+l2FileExt)); len(files) != 0 {
+		t.Fatalf("files %v after Clear", files)
+	}
+}
+
+// TestFileStore_Shrink 超过 maxBytes 时，有效数据多的段被淘汰，少的段被压缩
+func TestFileStore_Shrink(t *testing.T) {
+	m := newMetrics()
+	value := bytes.Repeat([]byte("v"), 50-l2HeaderSize)
+	// 每条记录 50 字节，每个段 4 条，最多 8 个段
+	s, err := newFileStore(t.TempDir(), 1600, clock.Real, time.Second, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	put := func(from, to uint64) {
+		for i := from; i <= to; i++ {
+			if err := s.Put(i, i, value, 1, time.Time{}, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(1, 32)
+	if s.total != 1600 || len(s.segments) != 8 {
+		t.Fatalf("total %d, segments %d", s.total, len(s.segments))
+	}
+
+	// 第一个段全是有效数据，整个淘汰
+	put(33, 33)
+	for i := uint64(1); i <= 4; i++ {
+		if _, _, ok := s.Get(i, i); ok {
+			t.Fatalf("%d should be evicted", i)
+		}
+	}
+	if m.L2KeysEvicted() != 4 {
+		t.Fatalf("L2KeysEvicted = %d, want 4", m.L2KeysEvicted())
+	}
+
+	// 第二个段只剩下 8，压缩时复制到最新的段
+	s.Del(5, 5)
+	s.Del(6, 6)
+	s.Del(7, 0)
+	put(34, 37)
+	if s.total > 1600 {
+		t.Fatalf("total %d > max bytes", s.total)
+	}
+	if m.L2KeysEvicted() != 4 {
+		t.Fatalf("L2KeysEvicted = %d, want 4", m.L2KeysEvicted())
+	}
+	for i := uint64(8); i <= 37; i++ {
+		if v, _, ok := s.Get(i, i); !ok || !bytes.Equal(v, value) {
+			t.Fatalf("%d should be kept after compaction", i)
+		}
+	}
+}
+
+// TestFileStore_Clean Clean 只处理时间轮中到期的 key
+func TestFileStore_Clean(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s, err := newFileStore(t.TempDir(), 1<<20, clk, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		if err = s.Put(i, i, []byte("v"), 1, clk.Now().Add(time.Duration(i)*time.Second), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Put(11, 11, []byte("v"), 1, time.Time{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	// 覆盖后以新的过期时间为准
+	if err = s.Put(1, 1, []byte("v"), 1, clk.Now().Add(time.Hour), 0); err != nil {
+		t.Fatal(err)
+	}
+	// 删除后不再由 Clean 处理
+	s.Del(2, 2)
+
+	// 时间轮按 tick 向上取整，最多晚一个 tick
+	clk.Add(6 * time.Second)
+	if n := s.Clean(); n != 3 {
+		t.Fatalf("Clean = %d, want 3", n)
+	}
+	if len(s.index) != 7 {
+		t.Fatalf("index has %d keys, want 7", len(s.index))
+	}
+	for _, i := range []uint64{1, 7, 10, 11} {
+		if _, _, ok := s.Get(i, i); !ok {
+			t.Fatalf("%d should not be expired", i)
+		}
+	}
+
+	clk.Add(5 * time.Second)
+	if n := s.Clean(); n != 5 {
+		t.Fatalf("Clean = %d, want 5", n)
+	}
+	if n := s.Clean(); n != 0 {
+		t.Fatalf("Clean again = %d, want 0", n)
+	}
+}
+
+// TestFileStore_Concurrent 读写文件时不持有锁，Get、Del 和 Put（包括压缩）并发时索引仍然正确
+func TestFileStore_Concurrent(t *testing.T) {
+	s, err := newFileStore(t.TempDir(), 4096, clock.Real, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	value := func(i uint64) []byte {
+		return []byte(strconv.FormatUint(i, 10))
+	}
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := uint64(0); i < 2000; i++ {
+			if err := s.Put(i%100, i%100, value(i%100), 1, time.Time{}, 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for g := 0; g < 2; g++ {
+		go func() {
+			defer wg.Done()
+			for i := uint64(0); i < 2000; i++ {
+				key := i % 100
+				if v, _, ok := s.Get(key, key); ok && !bytes.Equal(v, value(key)) {
+					t.Errorf("Get %d = %s", key, v)
+					return
+				}
+				if i%7 == 0 {
+					s.Del(key, key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.total > s.maxBytes {
+		t.Fatalf("total %d > max bytes", s.total)
+	}
+	for hashKey, e := range s.index {
+		if _, ok := e.seg.keys[hashKey]; !ok {
+			t.Fatalf("%d is not in its segment", hashKey)
+		}
+	}
+}
+
+func TestCache_L2(t *testing.T) {
+	codec := ValueCodec[int]{
+		Encode: func(value int) ([]byte, error) {
+			return []byte(strconv.Itoa(value)), nil
+		},
+		Decode: func(b []byte) (int, error) {
+			return strconv.Atoi(string(b))
+		},
+	}
+	c := New[int, int](100, 2, OptionL2(t.TempDir(), 1<<20, codec), OptionMetrics(), OptionRingBufferSize(1))
+	defer c.Close()
+	m := c.Metrics()
+
+	c.Add(1, 1, 1)
+	c.Add(2, 2, 1)
+	c.Wait()
+	// 3 的频率更高，淘汰一个写入 L2
+	for i := 0; i < 3; i++ {
+		c.Get(3)
+		time.Sleep(time.Millisecond)
+	}
+	c.Add(3, 3, 1)
+	c.Wait()
+	if m.L2KeysAdded() != 1 {
+		t.Fatalf("L2KeysAdded = %d, want 1", m.L2KeysAdded())
+	}
+
+	for i := 1; i <= 3; i++ {
+		if v, ok := c.Get(i); !ok || v != i {
+			t.Fatalf("Get %d = %d, %v", i, v, ok)
+		}
+	}
+	if m.L2Hits() != 1 {
+		t.Fatalf("L2Hits = %d, want 1", m.L2Hits())
+	}
+
+	// Del 也会删除 L2 中的值
+	c.Wait()
+	misses := m.L2Misses()
+	for i := 1; i <= 3; i++ {
+		c.Del(i)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, ok := c.Get(i); ok {
+			t.Fatalf("Get %d after Del should fail", i)
+		}
+	}
+	if m.L2Misses()-misses != 3 {
+		t.Fatalf("L2Misses = %d, want %d", m.L2Misses(), misses+3)
+	}
+}
@@ -0,0 +1,89 @@
+package cache
+
+import "container/list"
+
+// entry LRU、ARC 和 S3-FIFO 中保存的 key
+type entry struct {
+	hashKey uint64
+	cost    int64
+	// 访问次数，只有 S3-FIFO 用到
+	freq int
+}
+
+// costList 双向链表 + map，队首是最新加入（或最近访问）的，队尾是最先被淘汰的，同时统计链表中所有 key 的 cost
+// 不是并发安全的，由各个 policy 自己上锁
+type costList struct {
+	list  *list.List
+	items map[uint64]*list.Element
+	used  int64
+}
+
+func newCostList() *costList {
+	return &costList{
+		list:  list.New(),
+		items: make(map[uint64]*list.Element),
+	}
+}
+
+func (l *costList) get(hashKey uint64) (*entry, bool) {
+	elem, ok := l.items[hashKey]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*entry), true
+}
+
+// pushFront 调用方保证 key 不在链表中
+func (l *costList) pushFront(e *entry) {
+	l.items[e.hashKey] = l.list.PushFront(e)
+	l.used += e.cost
+}
+
+func (l *costList) moveToFront(hashKey uint64) bool {
+	elem, ok := l.items[hashKey]
+	if !ok {
+		return false
+	}
+	l.list.MoveToFront(elem)
+	return true
+}
+
+func (l *costList) remove(hashKey uint64) (*entry, bool) {
+	elem, ok := l.items[hashKey]
+	if !ok {
+		return nil, false
+	}
+	delete(l.items, hashKey)
+	l.list.Remove(elem)
+	e := elem.Value.(*entry)
+	l.used -= e.cost
+	return e, true
+}
+
+// back 队尾，为空则返回 nil
+func (l *costList) back() *entry {
+	elem := l.list.Back()
+	if elem == nil {
+		return nil
+	}
+	return elem.Value.(*entry)
+}
+
+// popBack 移除并返回队尾，为空则返回 nil
+func (l *costList) popBack() *entry {
+	e := l.back()
+	if e != nil {
+		l.remove(e.hashKey)
+	}
+	return e
+}
+
+func (l *costList) len() int {
+	return l.list.Len()
+}
+
+func (l *costList) clear() {
+	l.list.Init()
+	l.items = make(map[uint64]*list.Element)
+	l.used = 0
+}
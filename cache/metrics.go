@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+type metricType int
+
+const (
+	// hit Get 命中
+	hit = iota
+	// miss Get 没有命中
+	miss
+	// keyAdd 成功加入 store 的 key
+	keyAdd
+	// keyUpdate 已存在的 key 被更新
+	keyUpdate
+	// keyEvict 因空间不足被淘汰的 key
+	keyEvict
+	// keyExpire 因过期被定时删除的 key
+	keyExpire
+	// costAdd 成功加入的 cost
+	costAdd
+	// costEvict 被淘汰的 cost
+	costEvict
+	// dropSets addBuf 满了被丢弃的 Add
+	dropSets
+	// rejectSets 被准入策略拒绝的 Add
+	rejectSets
+	// dropGets policy.itemChan 满了被丢弃的 Get（即没有增加频率）
+	dropGets
+	// l2Hit L1 没有命中，L2 命中
+	l2Hit
+	// l2Miss L1 和 L2 都没有命中
+	l2Miss
+	// l2KeyAdd 从 L1 淘汰后写入 L2 的 key
+	l2KeyAdd
+	// l2KeyEvict 因 L2 空间不足被淘汰的 key
+	l2KeyEvict
+	// doNotUse 不使用，只用于表示有多少种 metricType
+	doNotUse
+)
+
+// metricShards 每种计数器分成多个，按 hashKey 分散，减少并发原子操作同一个变量的争用
+const metricShards = 256
+
+// Metrics 缓存的统计信息，通过 OptionMetrics 开启，没有开启时 Cache.Metrics 返回 nil
+// 所有方法都可以在 nil 上调用
+type Metrics struct {
+	all [doNotUse][]*uint64
+}
+
+func newMetrics() *Metrics {
+	m := &Metrics{}
+	for i := 0; i < doNotUse; i++ {
+		m.all[i] = make([]*uint64, metricShards)
+		for j := range m.all[i] {
+			m.all[i][j] = new(uint64)
+		}
+	}
+	return m
+}
+
+func (m *Metrics) add(t metricType, hashKey, delta uint64) {
+	if m == nil {
+		return
+	}
+	// 每隔 10 个取一个，即两个会被同时修改的计数器至少隔了 10 个指针，所指向的 uint64 大概率不在同一个 cache line，避免伪共享
+	idx := (hashKey % 25) * 10
+	atomic.AddUint64(m.all[t][idx], delta)
+}
+
+func (m *Metrics) get(t metricType) uint64 {
+	if m == nil {
+		return 0
+	}
+	var total uint64
+	for i := range m.all[t] {
+		total += atomic.LoadUint64(m.all[t][i])
+	}
+	return total
+}
+
+// Hits Get 命中的次数
+func (m *Metrics) Hits() uint64 {
+	return m.get(hit)
+}
+
+// Misses Get 没有命中的次数
+func (m *Metrics) Misses() uint64 {
+	return m.get(miss)
+}
+
+// KeysAdded 成功加入的 key 的数量
+func (m *Metrics) KeysAdded() uint64 {
+	return m.get(keyAdd)
+}
+
+// KeysUpdated 被更新的 key 的数量
+func (m *Metrics) KeysUpdated() uint64 {
+	return m.get(keyUpdate)
+}
+
+// KeysEvicted 因空间不足被淘汰的 key 的数量
+func (m *Metrics) KeysEvicted() uint64 {
+	return m.get(keyEvict)
+}
+
+// KeysExpired 因过期被删除的 key 的数量，包括定期清理和 Get 时发现过期
+func (m *Metrics) KeysExpired() uint64 {
+	return m.get(keyExpire)
+}
+
+// CostAdded 成功加入的 cost 总和
+func (m *Metrics) CostAdded() uint64 {
+	return m.get(costAdd)
+}
+
+// CostEvicted 因空间不足被淘汰的 cost 总和
+func (m *Metrics) CostEvicted() uint64 {
+	return m.get(costEvict)
+}
+
+// SetsDropped addBuf 满了（争用）被直接丢弃的 Add 的次数
+func (m *Metrics) SetsDropped() uint64 {
+	return m.get(dropSets)
+}
+
+// SetsRejected 被准入策略拒绝的 Add 的次数
+func (m *Metrics) SetsRejected() uint64 {
+	return m.get(rejectSets)
+}
+
+// GetsDropped policy 处理不过来被丢弃的 Get 的次数，这些 Get 没有增加频率
+func (m *Metrics) GetsDropped() uint64 {
+	return m.get(dropGets)
+}
+
+// L2Hits L1 没有命中但 L2 命中的次数，这些 Get 在 Misses 中也会计一次，没有开启 OptionL2 时为 0
+func (m *Metrics) L2Hits() uint64 {
+	return m.get(l2Hit)
+}
+
+// L2Misses L1 和 L2 都没有命中的次数
+func (m *Metrics) L2Misses() uint64 {
+	return m.get(l2Miss)
+}
+
+// L2KeysAdded 从 L1 淘汰后写入 L2 的 key 的数量
+func (m *Metrics) L2KeysAdded() uint64 {
+	return m.get(l2KeyAdd)
+}
+
+// L2KeysEvicted 因 L2 空间不足被淘汰的 key 的数量
+func (m *Metrics) L2KeysEvicted() uint64 {
+	return m.get(l2KeyEvict)
+}
+
+// Ratio 命中率，即 Hits / (Hits + Misses)
+func (m *Metrics) Ratio() float64 {
+	if m == nil {
+		return 0
+	}
+	hits, misses := m.get(hit), m.get(miss)
+	if hits == 0 && misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// Clear 所有计数器清零
+func (m *Metrics) Clear() {
+	if m == nil {
+		return
+	}
+	for i := range m.all {
+		for j := range m.all[i] {
+			atomic.StoreUint64(m.all[i][j], 0)
+		}
+	}
+}
+
+func (m *Metrics) String() string {
+	if m == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	for i := 0; i < doNotUse; i++ {
+		t := metricType(i)
+		fmt.Fprintf(&buf, "%s: %d ", t.String(), m.get(t))
+	}
+	fmt.Fprintf(&buf, "gets-total: %d ", m.get(hit)+m.get(miss))
+	fmt.Fprintf(&buf, "hit-ratio: %.2f", m.Ratio())
+	return buf.String()
+}
+
+func (t metricType) String() string {
+	switch t {
+	case hit:
+		return "hit"
+	case miss:
+		return "miss"
+	case keyAdd:
+		return "keys-added"
+	case keyUpdate:
+		return "keys-updated"
+	case keyEvict:
+		return "keys-evicted"
+	case keyExpire:
+		return "keys-expired"
+	case costAdd:
+		return "cost-added"
+	case costEvict:
+		return "cost-evicted"
+	case dropSets:
+		return "sets-dropped"
+	case rejectSets:
+		return "sets-rejected"
+	case dropGets:
+		return "gets-dropped"
+	case l2Hit:
+		return "l2-hit"
+	case l2Miss:
+		return "l2-miss"
+	case l2KeyAdd:
+		return "l2-keys-added"
+	case l2KeyEvict:
+		return "l2-keys-evicted"
+	default:
+		return "unidentified"
+	}
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	c := NewCache(4*10*10, 4, OptionMetrics(), OptionRingBufferSize(1))
+	m := c.Metrics()
+
+	for i := 0; i < 4; i++ {
+		c.Add(i, i, 1)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		c.Get(i)
+		time.Sleep(time.Millisecond)
+	}
+
+	if m.KeysAdded() != 4 || m.CostAdded() != 4 {
+		t.Fatalf("KeysAdded %d, CostAdded %d", m.KeysAdded(), m.CostAdded())
+	}
+	if m.Hits() != 4 || m.Misses() != 1 || m.Ratio() != 0.8 {
+		t.Fatalf("Hits %d, Misses %d, Ratio %f", m.Hits(), m.Misses(), m.Ratio())
+	}
+
+	// 5 的频率为 0，比所有的 key 都低，被准入策略拒绝
+	c.Add(5, 5, 1)
+	// 4 的频率比其他的 key 高，淘汰两个 key
+	for i := 0; i < 3; i++ {
+		c.Get(4)
+		time.Sleep(time.Millisecond)
+	}
+	c.Add(4, 4, 2)
+	time.Sleep(10 * time.Millisecond)
+
+	if m.SetsRejected() != 1 {
+		t.Fatalf("SetsRejected %d", m.SetsRejected())
+	}
+	if m.KeysEvicted() != 2 || m.CostEvicted() != 2 {
+		t.Fatalf("KeysEvicted %d, CostEvicted %d", m.KeysEvicted(), m.CostEvicted())
+	}
+
+	m.Clear()
+	if m.Hits() != 0 || m.Ratio() != 0 {
+		t.Fatalf("Clear failed")
+	}
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	c := NewCache(4*10, 4)
+	m := c.Metrics()
+	if m != nil {
+		t.Fatalf("Metrics should be nil")
+	}
+
+	// 在 nil 上调用不会 panic
+	c.Get(1)
+	m.Clear()
+	if m.Hits() != 0 || m.Ratio() != 0 || m.String() != "" {
+		t.Fatalf("nil Metrics should return zero")
+	}
+}
+
+func TestMetrics_Drop(t *testing.T) {
+	m := newMetrics()
+	policy := newDefaultPolicy(4*10, 4)
+	policy.CollectMetrics(m)
+
+	// 没有协程及时消费，itemChan 很快就满了
+	policy.mutex.Lock()
+	for i := 0; i < itemChanSize+2; i++ {
+		policy.ConsumeGet([]uint64{1, 2})
+	}
+	policy.mutex.Unlock()
+
+	if m.GetsDropped() == 0 {
+		t.Fatalf("GetsDropped should > 0")
+	}
+}
+
+// TestMetrics_AddFailed store.Add 失败时不统计 KeysAdded 和 CostAdded
+func TestMetrics_AddFailed(t *testing.T) {
+	c := New[int, int](100, 10, OptionMetrics())
+	defer c.Close()
+	m := c.Metrics()
+
+	// 直接放到 store 中，policy 中没有，policy.Add 会成功，但 store.Add 会失败
+	tc := c.(*typedCache[int, int])
+	hashKey, conflict := tc.hasher(1)
+	tc.store.Add(storeItem[int]{hashKey: hashKey, conflict: conflict, value: 1, cost: 1})
+
+	c.Add(1, 1, 2)
+	c.Wait()
+	if m.KeysAdded() != 0 || m.CostAdded() != 0 {
+		t.Fatalf("KeysAdded %d, CostAdded %d, want 0", m.KeysAdded(), m.CostAdded())
+	}
+}
@@ -1,17 +1,88 @@
 package cache
 
 import (
-	"math"
+	"math/rand"
 	"sync"
+	"time"
 )
 
-type policy interface {
-	// consumer.ConsumeGet 负责在缓冲区耗尽时批量接收并发送到 policy 的接受 chan 中处理
-	consumer
+// Policy 缓存的准入和淘汰策略，只保存 hashKey 和 cost，value 和过期时间由 cache 的 store 和 expiration 保存
+// 除了 ConsumeGet，其他方法都只会由 cache 的 process 协程调用，但 Frequency 可能被并发调用，所以实现需要自己保证并发安全
+// 内置了 NewDefaultPolicy（TinyLFU + 采样 LFU）、NewWTinyLFUPolicy、NewLRUPolicy、NewARCPolicy 和 NewS3FIFOPolicy，通过 OptionPolicy 选择
+type Policy interface {
+	// ConsumeGet Get 的 key 会批量传进来（不管是否命中），用于增加频率或移到队首等，返回 false 表示丢弃了
+	// 会被 Get 的调用方协程并发调用，所以不应该阻塞太久
+	ConsumeGet([]uint64) bool
 	// Add 把新的 key 加入缓存，如满足准入策略且缓存已满，则选择一部分需要淘汰的 key 返回
 	Add(uint64, int64) ([]uint64, bool)
 	// Del 删除缓存
 	Del(uint64)
+	// Update 更新已存在的 key 的 cost，如果 cost 变大导致容量不足，返回需要淘汰的 key（不会淘汰自己，除非 cost 超过总容量）
+	// key 不存在则返回 false
+	Update(uint64, int64) ([]uint64, bool)
+	// Clear 清空所有的 key 和频率
+	Clear()
+	// Frequency 返回 TinyLFU 估计的访问频率
+	Frequency(uint64) int
+	// CollectMetrics 开启统计，policy 负责统计被丢弃的 Get 和被淘汰的 key
+	CollectMetrics(*Metrics)
+	// Close 停止异步处理的协程
+	Close()
+}
+
+// NewPolicyFunc numCount 为计数器的数量，maxCost 为最大存储 cost 总数，同 NewCache 的参数
+type NewPolicyFunc func(numCount, maxCost int64) Policy
+
+// NewDefaultPolicy TinyLFU 准入 + 采样 LFU 淘汰，不传 OptionPolicy 时的默认策略
+func NewDefaultPolicy(numCount, maxCost int64) Policy {
+	return newDefaultPolicy(numCount, maxCost)
+}
+
+// Admission defaultPolicy 的准入方式
+type Admission int
+
+const (
+	// AdmitByFrequency 只比较频率，默认的方式
+	// 一个频率稍高的大 value 可能会挤掉很多小的热点 key，偏向字节命中率（byte hit ratio）
+	AdmitByFrequency Admission = iota
+	// AdmitByCost 比较每单位 cost 的频率（同 AdaptSize、size-aware TinyLFU）
+	// 新 key 的 频率/cost 不低于所有要淘汰的 key 的 总频率/总 cost 才加入，偏向对象命中率（object hit ratio）
+	AdmitByCost
+)
+
+// NewDefaultPolicyWithAdmission 同 NewDefaultPolicy，但可以选择准入方式，配合 OptionPolicy 使用
+func NewDefaultPolicyWithAdmission(admission Admission) NewPolicyFunc {
+	return NewDefaultPolicyWithOptions(PolicyOptionAdmission(admission))
+}
+
+// NewDefaultPolicyWithOptions 同 NewDefaultPolicy，可以通过 PolicyOptionXxx 修改配置，配合 OptionPolicy 使用
+func NewDefaultPolicyWithOptions(fns ...policyOptionFn) NewPolicyFunc {
+	return func(numCount, maxCost int64) Policy {
+		policy := newDefaultPolicy(numCount, maxCost)
+		for i := range fns {
+			fns[i](policy)
+		}
+		return policy
+	}
+}
+
+type policyOptionFn func(*defaultPolicy)
+
+// PolicyOptionAdmission 准入方式，默认为 AdmitByFrequency
+func PolicyOptionAdmission(admission Admission) func(policy *defaultPolicy) {
+	return func(policy *defaultPolicy) {
+		policy.admission = admission
+	}
+}
+
+// PolicyOptionSampleSize 每次淘汰时随机采样的 key 的数量，默认为 5
+// 越大越接近真正的 LFU，但淘汰越慢。因为有淘汰池保留之前采样的候选者，一般不需要太大
+func PolicyOptionSampleSize(size int) func(policy *defaultPolicy) {
+	return func(policy *defaultPolicy) {
+		if size > 0 {
+			policy.sampleSize = size
+		}
+	}
 }
 
 const (
@@ -26,17 +97,32 @@ type defaultPolicy struct {
 	// 存储所有的 key 和 cost，为什么？
 	// 其实是为了和 store 解耦，两方互不干扰。确实是冗余了。
 	// 如果不想冗余，就直接让 store 暴露一个随机获取的方法，然后 policy 调用即可。但是双方方会耦合在一起。
-	evict    *sampledLFU
-	itemChan chan []uint64
+	evict *sampledLFU
+	// 淘汰池，保留之前采样的最好的候选者，见 evictionPool
+	pool *evictionPool
+	// 每次淘汰采样的 key 的数量
+	sampleSize int
+	itemChan   chan []uint64
+	metrics    *Metrics
+	// 准入方式，见 Admission
+	admission Admission
+	// 关闭信号
+	stop chan struct{}
+	// processItems 退出后 close
+	done chan struct{}
 }
 
 func newDefaultPolicy(numCount int64, maxCost int64) *defaultPolicy {
 	newPolicy := &defaultPolicy{
 		// numCount 是计数器的容量，建议为该缓存中总容量的的 10 倍
-		admit: newTinyLFU(numCount),
-		evict: newSampledFlU(maxCost),
+		admit:      newTinyLFU(numCount),
+		evict:      newSampledFlU(maxCost),
+		pool:       newEvictionPool(),
+		sampleSize: samplelfu,
 		// 为什么才 3？ristretto 解释说避免消耗太多的 CPU 来处理？？？
 		itemChan: make(chan []uint64, itemChanSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
 	}
 
 	// 守护协程异步批量处理
@@ -46,6 +132,7 @@ func newDefaultPolicy(numCount int64, maxCost int64) *defaultPolicy {
 }
 
 func (policy *defaultPolicy) processItems() {
+	defer close(policy.done)
 	for {
 		select {
 		case hashKeys := <-policy.itemChan:
@@ -54,10 +141,18 @@ func (policy *defaultPolicy) processItems() {
 				policy.admit.incrementFre(hashKeys[i])
 			}
 			policy.mutex.Unlock()
+		case <-policy.stop:
+			return
 		}
 	}
 }
 
+// Close 只能调用一次，由 cache.Close 保证
+func (policy *defaultPolicy) Close() {
+	close(policy.stop)
+	<-policy.done
+}
+
 // ConsumeGet 例外，不需要上锁，由 chan 内部保证
 func (policy *defaultPolicy) ConsumeGet(hashKeys []uint64) bool {
 	select {
@@ -65,6 +160,9 @@ func (policy *defaultPolicy) ConsumeGet(hashKeys []uint64) bool {
 		return true
 	default:
 		// 抗争用，如果缓冲区满了，不要阻塞直接丢弃
+		if len(hashKeys) > 0 {
+			policy.metrics.add(dropGets, hashKeys[0], uint64(len(hashKeys)))
+		}
 		return false
 	}
 }
@@ -78,7 +176,7 @@ func (policy *defaultPolicy) Add(hashKey uint64, cost int64) ([]uint64, bool) {
 		return nil, false
 	}
 
-	// 已存在，因为并不提供修改缓存的功能，所以直接返回
+	// 已存在，修改缓存走的是 Update，所以直接返回
 	if _, ok := policy.evict.getCost(hashKey); ok {
 		return nil, false
 	}
@@ -91,42 +189,34 @@ func (policy *defaultPolicy) Add(hashKey uint64, cost int64) ([]uint64, bool) {
 		return nil, true
 	}
 
-	addItemFre := policy.admit.getFrequent(hashKey)
-	sampleItems := make([]keyPair, 0, samplelfu)
+	if policy.admission == AdmitByCost {
+		return policy.addByCost(hashKey, cost, remainRom)
+	}
+
+	addItemFre := int64(policy.admit.getFrequent(hashKey))
 	var out []uint64
 
 	for remainRom < 0 {
-		policy.evict.fillSample(&sampleItems)
-
-		// 遍历找到最小的
-		var minFre = math.MaxInt
-		var minKeyPair keyPair
-		var minIndex int
-		for index := range sampleItems {
-			fre := policy.admit.getFrequent(sampleItems[index].hashKey)
-			if fre < minFre {
-				minFre = fre
-				minIndex = index
-				minKeyPair.hashKey = sampleItems[index].hashKey
-				minKeyPair.cost = sampleItems[index].cost
-			}
+		victim, ok := policy.popVictim(hashKey, nil)
+		if !ok {
+			return out, false
 		}
 
-		// 不符合准入策略
-		if minFre > addItemFre {
+		// 不符合准入策略，候选者放回淘汰池，下次还能用
+		if victim.fre > addItemFre {
+			policy.pool.push(victim, policy.less)
 			return out, false
 		}
 
-		// 把最小的踢出去 sample
-		sampleItems[minIndex] = sampleItems[len(sampleItems)-1]
-		sampleItems = sampleItems[:len(sampleItems)-1]
 		// 加入淘汰 slice
-		out = append(out, minKeyPair.hashKey)
+		out = append(out, victim.hashKey)
 
 		// 从 policy 中删除
-		policy.evict.del(minKeyPair.hashKey)
+		policy.evict.del(victim.hashKey)
+		policy.metrics.add(keyEvict, victim.hashKey, 1)
+		policy.metrics.add(costEvict, victim.hashKey, uint64(victim.cost))
 		// 增加剩余空间
-		remainRom += minKeyPair.cost
+		remainRom += victim.cost
 	}
 
 	// 加入 policy
@@ -135,14 +225,170 @@ func (policy *defaultPolicy) Add(hashKey uint64, cost int64) ([]uint64, bool) {
 	return out, true
 }
 
+// addByCost 先选出足够腾出空间的淘汰者（每次选 频率/cost 最小的），再整体和新 key 比较 频率/cost
+// 和 AdmitByFrequency 不同，不加入时不会淘汰任何 key，调用方需要上锁
+func (policy *defaultPolicy) addByCost(hashKey uint64, cost int64, remainRoom int64) ([]uint64, bool) {
+	victims := make(map[uint64]struct{})
+	var victimFre, victimCost int64
+	var out []poolItem
+
+	for remainRoom < 0 {
+		victim, ok := policy.popVictim(hashKey, victims)
+		if !ok {
+			break
+		}
+
+		victims[victim.hashKey] = struct{}{}
+		out = append(out, victim)
+		victimFre += victim.fre
+		victimCost += victim.cost
+		remainRoom += victim.cost
+	}
+
+	// 腾不出空间，或者不符合准入策略：addFre / cost < victimFre / victimCost（交叉相乘避免浮点数）
+	if remainRoom < 0 || int64(policy.admit.getFrequent(hashKey))*victimCost < victimFre*cost {
+		// 候选者都放回淘汰池
+		for _, victim := range out {
+			policy.pool.push(victim, policy.less)
+		}
+		return nil, false
+	}
+
+	outKeys := make([]uint64, 0, len(out))
+	for _, victim := range out {
+		outKeys = append(outKeys, victim.hashKey)
+		policy.evict.del(victim.hashKey)
+		policy.metrics.add(keyEvict, victim.hashKey, 1)
+		policy.metrics.add(costEvict, victim.hashKey, uint64(victim.cost))
+	}
+	policy.evict.add(hashKey, cost)
+
+	return outKeys, true
+}
+
+// popVictim 随机采样填充淘汰池，再从淘汰池中取出最好的候选者（跳过 self 和 except 中的 key），调用方需要上锁
+func (policy *defaultPolicy) popVictim(self uint64, except map[uint64]struct{}) (poolItem, bool) {
+	policy.evict.sample(policy.sampleSize, func(hashKey uint64, cost int64) {
+		if _, ok := except[hashKey]; ok || hashKey == self {
+			return
+		}
+		policy.pool.push(poolItem{
+			hashKey: hashKey,
+			cost:    cost,
+			fre:     int64(policy.admit.getFrequent(hashKey)),
+		}, policy.less)
+	})
+
+	victim, ok := policy.pool.pop(func(item poolItem) bool {
+		if _, ok := except[item.hashKey]; ok || item.hashKey == self {
+			return false
+		}
+		// 加入淘汰池后可能已经被删除了，或者 cost 被修改了
+		cost, ok := policy.evict.getCost(item.hashKey)
+		return ok && cost == item.cost
+	})
+	// 加入淘汰池后频率可能变了，准入策略用最新的频率比较
+	victim.fre = int64(policy.admit.getFrequent(victim.hashKey))
+	return victim, ok
+}
+
+// less a 是否比 b 更应该被淘汰
+func (policy *defaultPolicy) less(a, b poolItem) bool {
+	if policy.admission == AdmitByCost {
+		return a.fre*b.cost < b.fre*a.cost
+	}
+	return a.fre < b.fre
+}
+
 func (policy *defaultPolicy) Del(hashKey uint64) {
 	policy.mutex.Lock()
 	policy.evict.del(hashKey)
 	policy.mutex.Unlock()
 }
 
+func (policy *defaultPolicy) Update(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	if _, ok := policy.evict.getCost(hashKey); !ok {
+		return nil, false
+	}
+
+	// 超过总容量，只能把自己淘汰
+	if cost > policy.evict.getMaxCost() {
+		policy.evict.del(hashKey)
+		return []uint64{hashKey}, true
+	}
+
+	policy.evict.updateCost(hashKey, cost)
+
+	// 容量不足，淘汰频率最小的，已经在缓存中了，所以不需要再经过准入策略
+	var out []uint64
+	for remainRoom := policy.evict.remainRoom(0); remainRoom < 0; {
+		victim, ok := policy.popVictim(hashKey, nil)
+		// 只剩下自己了
+		if !ok {
+			break
+		}
+
+		out = append(out, victim.hashKey)
+		policy.evict.del(victim.hashKey)
+		policy.metrics.add(keyEvict, victim.hashKey, 1)
+		policy.metrics.add(costEvict, victim.hashKey, uint64(victim.cost))
+		remainRoom += victim.cost
+	}
+
+	return out, true
+}
+
+func (policy *defaultPolicy) Clear() {
+	policy.mutex.Lock()
+	policy.admit.clear()
+	policy.evict.clear()
+	policy.pool.clear()
+	policy.mutex.Unlock()
+}
+
+// CollectMetrics 在创建 cache 时调用，此时还没有并发，所以不需要上锁
+func (policy *defaultPolicy) CollectMetrics(metrics *Metrics) {
+	policy.metrics = metrics
+}
+
+func (policy *defaultPolicy) Frequency(hashKey uint64) int {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	return policy.admit.getFrequent(hashKey)
+}
+
+// used 已使用的容量
+func (policy *defaultPolicy) used() int64 {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	return policy.evict.used
+}
+
+func (policy *defaultPolicy) restoreFrequency(hashKey uint64, fre int) {
+	policy.mutex.Lock()
+	policy.admit.restore(hashKey, fre)
+	policy.mutex.Unlock()
+}
+
+func (policy *defaultPolicy) copySketch() *tinyLFU {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	return cloneTinyLFU(policy.admit)
+}
+
+func (policy *defaultPolicy) replaceSketch(s *tinyLFU) bool {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	return policy.admit.replace(s)
+}
+
 type tinyLFU struct {
-	fre   *cmSketch
+	fre *cmSketch
+	// doorkeeper 吸收每个 key 的第一次访问，见 bloom
+	door  *bloom
 	incrs int64
 	// incrs 到达 reset 后需要进行保鲜，所有 fre 减半
 	reset int64
@@ -151,41 +397,94 @@ type tinyLFU struct {
 func newTinyLFU(numCount int64) *tinyLFU {
 	return &tinyLFU{
 		fre:   newCmSketch(numCount),
+		door:  newBloom(numCount),
 		reset: numCount,
 	}
 }
 
 func (tinyLFU *tinyLFU) incrementFre(hashKey uint64) {
-	tinyLFU.fre.Increment(hashKey)
+	// 第一次访问只记录在 doorkeeper 中
+	if !tinyLFU.door.addIfNotHas(hashKey) {
+		tinyLFU.fre.Increment(hashKey)
+	}
 
 	tinyLFU.incrs++
-	// 保鲜，全部频率减半
-	if tinyLFU.incrs == tinyLFU.reset {
+	// 保鲜，全部频率减半，doorkeeper 清空
+	// 以前这里还把 reset 置为 0，导致只会保鲜一次
+	if tinyLFU.incrs >= tinyLFU.reset {
 		tinyLFU.fre.Reset()
+		tinyLFU.door.clear()
 		tinyLFU.incrs = 0
-		tinyLFU.reset = 0
 	}
 }
 
+// restore 把 hashKey 的频率恢复到 fre，只会增加不会减少
+// 直接写入 doorkeeper 和 cmSketch，不计入 incrs，否则加载很多 key 时会在中途保鲜，前面恢复的频率被减半
+func (tinyLFU *tinyLFU) restore(hashKey uint64, fre int) {
+	for i := tinyLFU.getFrequent(hashKey); i < fre; i++ {
+		if !tinyLFU.door.addIfNotHas(hashKey) {
+			tinyLFU.fre.Increment(hashKey)
+		}
+	}
+}
+
+// getFrequent cmSketch 的计数加上 doorkeeper 中的那一次
 func (tinyLFU *tinyLFU) getFrequent(hashKey uint64) int {
-	return tinyLFU.fre.Estimate(hashKey)
+	fre := tinyLFU.fre.Estimate(hashKey)
+	if tinyLFU.door.has(hashKey) {
+		fre++
+	}
+	return fre
+}
+
+// cloneTinyLFU 复制计数器、种子和 doorkeeper，用于保存快照，调用方需要上锁
+func cloneTinyLFU(src *tinyLFU) *tinyLFU {
+	fre := &cmSketch{seed: src.fre.seed, mask: src.fre.mask}
+	for i := range fre.rows {
+		fre.rows[i] = append(cmRow(nil), src.fre.rows[i]...)
+	}
+	return &tinyLFU{
+		fre:   fre,
+		door:  &bloom{bits: append([]uint64(nil), src.door.bits...), mask: src.door.mask},
+		incrs: src.incrs,
+		reset: src.reset,
+	}
+}
+
+// replace 用快照中的 s 替换，大小不一样（numCount 改了）时不替换并返回 false
+func (tinyLFU *tinyLFU) replace(s *tinyLFU) bool {
+	if s.fre.mask != tinyLFU.fre.mask || s.door.mask != tinyLFU.door.mask || s.reset != tinyLFU.reset {
+		return false
+	}
+	tinyLFU.fre = s.fre
+	tinyLFU.door = s.door
+	tinyLFU.incrs = s.incrs
+	return true
+}
+
+func (tinyLFU *tinyLFU) clear() {
+	tinyLFU.fre.Clear()
+	tinyLFU.door.clear()
+	tinyLFU.incrs = 0
 }
 
 type sampledLFU struct {
 	maxCost  int64
 	used     int64
 	keyCosts map[uint64]int64
-}
-
-type keyPair struct {
-	hashKey uint64
-	cost    int64
+	// 以前利用 map 随机遍历的特性来采样，但 map 的遍历顺序并不是均匀随机的（从随机的桶开始顺序遍历）
+	// 所以另外用 slice 保存所有的 key，随机取下标来采样，index 保存 key 在 keys 中的下标，删除时和最后一个交换
+	keys  []uint64
+	index map[uint64]int
+	rand  *rand.Rand
 }
 
 func newSampledFlU(maxCost int64) *sampledLFU {
 	return &sampledLFU{
 		maxCost:  maxCost,
 		keyCosts: make(map[uint64]int64),
+		index:    make(map[uint64]int),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
 	}
 }
 
@@ -205,24 +504,46 @@ func (sampledLFU *sampledLFU) remainRoom(cost int64) int64 {
 func (sampledLFU *sampledLFU) add(hashKey uint64, cost int64) {
 	sampledLFU.keyCosts[hashKey] = cost
 	sampledLFU.used += cost
+	sampledLFU.index[hashKey] = len(sampledLFU.keys)
+	sampledLFU.keys = append(sampledLFU.keys, hashKey)
+}
+
+// updateCost 调用方保证 hashKey 存在
+func (sampledLFU *sampledLFU) updateCost(hashKey uint64, cost int64) {
+	sampledLFU.used += cost - sampledLFU.keyCosts[hashKey]
+	sampledLFU.keyCosts[hashKey] = cost
+}
+
+func (sampledLFU *sampledLFU) clear() {
+	sampledLFU.keyCosts = make(map[uint64]int64)
+	sampledLFU.index = make(map[uint64]int)
+	sampledLFU.keys = nil
+	sampledLFU.used = 0
 }
 
 func (sampledLFU *sampledLFU) del(hashKey uint64) {
-	if cost, ok := sampledLFU.getCost(hashKey); ok {
-		delete(sampledLFU.keyCosts, hashKey)
-		sampledLFU.used -= cost
+	cost, ok := sampledLFU.getCost(hashKey)
+	if !ok {
+		return
 	}
+	delete(sampledLFU.keyCosts, hashKey)
+	sampledLFU.used -= cost
+
+	// 和最后一个交换后删除最后一个
+	i, last := sampledLFU.index[hashKey], len(sampledLFU.keys)-1
+	sampledLFU.keys[i] = sampledLFU.keys[last]
+	sampledLFU.index[sampledLFU.keys[i]] = i
+	sampledLFU.keys = sampledLFU.keys[:last]
+	delete(sampledLFU.index, hashKey)
 }
 
-func (sampledLFU *sampledLFU) fillSample(sampleItems *[]keyPair) {
-	// 利用 map 随机遍历的特性
-	for hashKey, cost := range sampledLFU.keyCosts {
-		*sampleItems = append(*sampleItems, keyPair{
-			hashKey: hashKey,
-			cost:    cost})
-
-		if len(*sampleItems) >= samplelfu {
-			return
-		}
+// sample 均匀随机（可能重复）采样 n 个 key
+func (sampledLFU *sampledLFU) sample(n int, fn func(hashKey uint64, cost int64)) {
+	if len(sampledLFU.keys) == 0 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		hashKey := sampledLFU.keys[sampledLFU.rand.Intn(len(sampledLFU.keys))]
+		fn(hashKey, sampledLFU.keyCosts[hashKey])
 	}
 }
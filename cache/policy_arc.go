@@ -0,0 +1,186 @@
+package cache
+
+import "sync"
+
+// arcPolicy ARC（Adaptive Replacement Cache），按 cost 而不是个数计算容量
+// t1 保存只访问过一次的 key，t2 保存访问过多次的 key，b1、b2 分别是从 t1、t2 淘汰的幽灵 key（只记录 key 和 cost）
+// 命中 b1 说明 t1 太小了，增大 t1 的目标容量 p；命中 b2 则减小 p。这样就能在最近访问和频繁访问之间自适应
+type arcPolicy struct {
+	mutex   sync.Mutex
+	maxCost int64
+	// t1 的目标容量
+	p       int64
+	t1      *costList
+	t2      *costList
+	b1      *costList
+	b2      *costList
+	metrics *Metrics
+}
+
+// NewARCPolicy 适合扫描和频繁访问混合的场景，numCount 没有用到
+func NewARCPolicy(_, maxCost int64) Policy {
+	return &arcPolicy{
+		maxCost: maxCost,
+		t1:      newCostList(),
+		t2:      newCostList(),
+		b1:      newCostList(),
+		b2:      newCostList(),
+	}
+}
+
+// ConsumeGet 命中 t1 则移到 t2，命中 t2 则移到队首，直接上锁同步处理
+func (policy *arcPolicy) ConsumeGet(hashKeys []uint64) bool {
+	policy.mutex.Lock()
+	for i := range hashKeys {
+		if e, ok := policy.t1.remove(hashKeys[i]); ok {
+			policy.t2.pushFront(e)
+			continue
+		}
+		policy.t2.moveToFront(hashKeys[i])
+	}
+	policy.mutex.Unlock()
+	return true
+}
+
+func (policy *arcPolicy) Add(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	if cost > policy.maxCost {
+		return nil, false
+	}
+	if _, ok := policy.t1.get(hashKey); ok {
+		return nil, false
+	}
+	if _, ok := policy.t2.get(hashKey); ok {
+		return nil, false
+	}
+
+	e := &entry{hashKey: hashKey, cost: cost}
+
+	// 命中 b1，增大 t1 的目标容量
+	if _, ok := policy.b1.remove(hashKey); ok {
+		policy.p += cost * ratio(policy.b2.used, policy.b1.used+cost)
+		if policy.p > policy.maxCost {
+			policy.p = policy.maxCost
+		}
+		out := policy.replace(cost, false)
+		policy.t2.pushFront(e)
+		return out, true
+	}
+
+	// 命中 b2，减小 t1 的目标容量
+	if _, ok := policy.b2.remove(hashKey); ok {
+		policy.p -= cost * ratio(policy.b1.used, policy.b2.used+cost)
+		if policy.p < 0 {
+			policy.p = 0
+		}
+		out := policy.replace(cost, true)
+		policy.t2.pushFront(e)
+		return out, true
+	}
+
+	// 全新的 key，先限制幽灵队列的大小：t1 + b1 不超过总容量，全部加起来不超过两倍总容量
+	for policy.b1.len() > 0 && policy.t1.used+policy.b1.used+cost > policy.maxCost {
+		policy.b1.popBack()
+	}
+	for policy.b2.len() > 0 && policy.t1.used+policy.t2.used+policy.b1.used+policy.b2.used+cost > 2*policy.maxCost {
+		policy.b2.popBack()
+	}
+
+	out := policy.replace(cost, false)
+	policy.t1.pushFront(e)
+	return out, true
+}
+
+// ratio 幽灵队列的大小之比，最小为 1
+func ratio(a, b int64) int64 {
+	if b == 0 || a <= b {
+		return 1
+	}
+	return a / b
+}
+
+// replace 淘汰直到能放下 cost，t1 超过目标容量则从 t1 淘汰，否则从 t2 淘汰，调用方需要上锁
+func (policy *arcPolicy) replace(cost int64, hitB2 bool) []uint64 {
+	var out []uint64
+	for policy.t1.used+policy.t2.used+cost > policy.maxCost {
+		var e *entry
+		if policy.t1.len() > 0 && (policy.t1.used > policy.p || (hitB2 && policy.t1.used == policy.p) || policy.t2.len() == 0) {
+			e = policy.t1.popBack()
+			policy.b1.pushFront(&entry{hashKey: e.hashKey, cost: e.cost})
+		} else if policy.t2.len() > 0 {
+			e = policy.t2.popBack()
+			policy.b2.pushFront(&entry{hashKey: e.hashKey, cost: e.cost})
+		} else {
+			break
+		}
+
+		out = append(out, e.hashKey)
+		policy.metrics.add(keyEvict, e.hashKey, 1)
+		policy.metrics.add(costEvict, e.hashKey, uint64(e.cost))
+	}
+	return out
+}
+
+func (policy *arcPolicy) Del(hashKey uint64) {
+	policy.mutex.Lock()
+	if _, ok := policy.t1.remove(hashKey); !ok {
+		policy.t2.remove(hashKey)
+	}
+	policy.mutex.Unlock()
+}
+
+func (policy *arcPolicy) Update(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	// 先把自己移出来，这样就不会淘汰自己了
+	list := policy.t1
+	e, ok := list.remove(hashKey)
+	if !ok {
+		list = policy.t2
+		if e, ok = list.remove(hashKey); !ok {
+			return nil, false
+		}
+	}
+
+	// 超过总容量，只能把自己淘汰
+	if cost > policy.maxCost {
+		return []uint64{hashKey}, true
+	}
+
+	out := policy.replace(cost, false)
+	e.cost = cost
+	list.pushFront(e)
+	return out, true
+}
+
+func (policy *arcPolicy) Clear() {
+	policy.mutex.Lock()
+	policy.p = 0
+	policy.t1.clear()
+	policy.t2.clear()
+	policy.b1.clear()
+	policy.b2.clear()
+	policy.mutex.Unlock()
+}
+
+// Frequency ARC 只区分访问过一次（t1）和多次（t2），分别返回 1 和 2，不在缓存中返回 0
+func (policy *arcPolicy) Frequency(hashKey uint64) int {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	if _, ok := policy.t1.get(hashKey); ok {
+		return 1
+	}
+	if _, ok := policy.t2.get(hashKey); ok {
+		return 2
+	}
+	return 0
+}
+
+func (policy *arcPolicy) CollectMetrics(metrics *Metrics) {
+	policy.metrics = metrics
+}
+
+func (policy *arcPolicy) Close() {}
@@ -0,0 +1,36 @@
+package cache
+
+import "testing"
+
+func TestARCPolicy(t *testing.T) {
+	policy := NewARCPolicy(0, 4).(*arcPolicy)
+
+	for i := uint64(1); i <= 4; i++ {
+		policy.Add(i, 1)
+	}
+	// 访问过多次的 1、2 进入 t2
+	policy.ConsumeGet([]uint64{1, 2})
+	if policy.Frequency(1) != 2 || policy.Frequency(3) != 1 {
+		t.Fatalf("1 should be in t2 and 3 should be in t1")
+	}
+
+	// t1 超过目标容量 0，从 t1 淘汰最久的 3
+	if out, ok := policy.Add(5, 1); !ok || len(out) != 1 || out[0] != 3 {
+		t.Fatalf("should evict 3, but %v", out)
+	}
+	if _, ok := policy.b1.get(3); !ok {
+		t.Fatalf("3 should be in b1")
+	}
+
+	// 命中 b1，t1 的目标容量增大，直接进入 t2
+	policy.Add(3, 1)
+	if policy.p == 0 {
+		t.Fatalf("p should increase after hit b1")
+	}
+	if policy.Frequency(3) != 2 {
+		t.Fatalf("3 should be in t2")
+	}
+	if policy.t1.used+policy.t2.used > 4 {
+		t.Fatalf("used should not exceed max cost")
+	}
+}
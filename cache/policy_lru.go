@@ -0,0 +1,102 @@
+package cache
+
+import "sync"
+
+// lruPolicy 没有准入策略，总是加入，容量不足时淘汰最久没有访问的
+type lruPolicy struct {
+	mutex   sync.Mutex
+	maxCost int64
+	items   *costList
+	metrics *Metrics
+}
+
+// NewLRUPolicy 适合只看最近访问、没有频率倾斜的场景，numCount 没有用到
+func NewLRUPolicy(_, maxCost int64) Policy {
+	return &lruPolicy{
+		maxCost: maxCost,
+		items:   newCostList(),
+	}
+}
+
+// ConsumeGet 移到队首很快，所以直接上锁同步处理，不需要像 defaultPolicy 一样再开一个协程
+func (policy *lruPolicy) ConsumeGet(hashKeys []uint64) bool {
+	policy.mutex.Lock()
+	for i := range hashKeys {
+		policy.items.moveToFront(hashKeys[i])
+	}
+	policy.mutex.Unlock()
+	return true
+}
+
+func (policy *lruPolicy) Add(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	if cost > policy.maxCost {
+		return nil, false
+	}
+	if _, ok := policy.items.get(hashKey); ok {
+		return nil, false
+	}
+
+	out := policy.evict(cost)
+	policy.items.pushFront(&entry{hashKey: hashKey, cost: cost})
+	return out, true
+}
+
+// evict 从队尾开始淘汰，直到能放下 cost，调用方需要上锁
+func (policy *lruPolicy) evict(cost int64) []uint64 {
+	var out []uint64
+	for policy.items.used+cost > policy.maxCost {
+		e := policy.items.popBack()
+		if e == nil {
+			break
+		}
+		out = append(out, e.hashKey)
+		policy.metrics.add(keyEvict, e.hashKey, 1)
+		policy.metrics.add(costEvict, e.hashKey, uint64(e.cost))
+	}
+	return out
+}
+
+func (policy *lruPolicy) Del(hashKey uint64) {
+	policy.mutex.Lock()
+	policy.items.remove(hashKey)
+	policy.mutex.Unlock()
+}
+
+func (policy *lruPolicy) Update(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	if _, ok := policy.items.remove(hashKey); !ok {
+		return nil, false
+	}
+
+	// 超过总容量，只能把自己淘汰
+	if cost > policy.maxCost {
+		return []uint64{hashKey}, true
+	}
+
+	// 先把自己移出来，这样就不会淘汰自己了，更新也算一次访问，所以放回队首
+	out := policy.evict(cost)
+	policy.items.pushFront(&entry{hashKey: hashKey, cost: cost})
+	return out, true
+}
+
+func (policy *lruPolicy) Clear() {
+	policy.mutex.Lock()
+	policy.items.clear()
+	policy.mutex.Unlock()
+}
+
+// Frequency LRU 不统计频率，总是返回 0
+func (policy *lruPolicy) Frequency(uint64) int {
+	return 0
+}
+
+func (policy *lruPolicy) CollectMetrics(metrics *Metrics) {
+	policy.metrics = metrics
+}
+
+func (policy *lruPolicy) Close() {}
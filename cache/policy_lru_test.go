@@ -0,0 +1,35 @@
+package cache
+
+import "testing"
+
+func TestLRUPolicy(t *testing.T) {
+	policy := NewLRUPolicy(0, 4)
+
+	for i := uint64(1); i <= 4; i++ {
+		if _, ok := policy.Add(i, 1); !ok {
+			t.Fatalf("Add %d failed", i)
+		}
+	}
+	if _, ok := policy.Add(1, 1); ok {
+		t.Fatalf("Add exist key should fail")
+	}
+
+	// 访问 1，最久没有访问的变成了 2
+	policy.ConsumeGet([]uint64{1})
+	if out, ok := policy.Add(5, 1); !ok || len(out) != 1 || out[0] != 2 {
+		t.Fatalf("should evict 2, but %v", out)
+	}
+
+	// 更新不会淘汰自己，淘汰 3、4
+	if out, ok := policy.Update(5, 3); !ok || len(out) != 2 || out[0] != 3 || out[1] != 4 {
+		t.Fatalf("should evict 3 and 4, but %v", out)
+	}
+	if out, ok := policy.Update(5, 5); !ok || len(out) != 1 || out[0] != 5 {
+		t.Fatalf("should evict itself, but %v", out)
+	}
+
+	policy.Clear()
+	if _, ok := policy.Update(1, 1); ok {
+		t.Fatalf("Clear failed")
+	}
+}
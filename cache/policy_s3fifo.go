@@ -0,0 +1,198 @@
+package cache
+
+import "sync"
+
+const (
+	// s3fifoSmallRatio 小队列占总容量的 1/s3fifoSmallRatio
+	s3fifoSmallRatio = 10
+	// s3fifoMaxFreq 访问次数最多记到 3
+	s3fifoMaxFreq = 3
+)
+
+// s3fifoPolicy S3-FIFO：一个小 FIFO 队列、一个主 FIFO 队列和一个幽灵队列
+// 新的 key 先进入小队列，在小队列中被访问过两次以上才进入主队列，否则直接淘汰并记录到幽灵队列，
+// 所以只访问一次的 key（例如扫描）很快就被淘汰了，不会把主队列的 key 挤出去
+// 幽灵队列中的 key 再次加入时直接进入主队列
+type s3fifoPolicy struct {
+	mutex    sync.Mutex
+	maxCost  int64
+	smallMax int64
+	small    *costList
+	main     *costList
+	// 只记录 key 和 cost，不占用缓存的容量
+	ghost   *costList
+	metrics *Metrics
+}
+
+// NewS3FIFOPolicy 适合扫描较多的场景，numCount 没有用到
+func NewS3FIFOPolicy(_, maxCost int64) Policy {
+	smallMax := maxCost / s3fifoSmallRatio
+	if smallMax == 0 {
+		smallMax = 1
+	}
+	return &s3fifoPolicy{
+		maxCost:  maxCost,
+		smallMax: smallMax,
+		small:    newCostList(),
+		main:     newCostList(),
+		ghost:    newCostList(),
+	}
+}
+
+// ConsumeGet 只增加访问次数，不移动位置，所以很快，直接上锁同步处理
+func (policy *s3fifoPolicy) ConsumeGet(hashKeys []uint64) bool {
+	policy.mutex.Lock()
+	for i := range hashKeys {
+		e, ok := policy.small.get(hashKeys[i])
+		if !ok {
+			e, ok = policy.main.get(hashKeys[i])
+		}
+		if ok && e.freq < s3fifoMaxFreq {
+			e.freq++
+		}
+	}
+	policy.mutex.Unlock()
+	return true
+}
+
+func (policy *s3fifoPolicy) Add(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	if cost > policy.maxCost {
+		return nil, false
+	}
+	if _, ok := policy.get(hashKey); ok {
+		return nil, false
+	}
+
+	out := policy.evict(cost)
+
+	e := &entry{hashKey: hashKey, cost: cost}
+	if _, ok := policy.ghost.remove(hashKey); ok {
+		policy.main.pushFront(e)
+	} else {
+		policy.small.pushFront(e)
+	}
+	return out, true
+}
+
+// get 调用方需要上锁
+func (policy *s3fifoPolicy) get(hashKey uint64) (*entry, bool) {
+	if e, ok := policy.small.get(hashKey); ok {
+		return e, true
+	}
+	return policy.main.get(hashKey)
+}
+
+// evict 淘汰直到能放下 cost，调用方需要上锁
+func (policy *s3fifoPolicy) evict(cost int64) []uint64 {
+	var out []uint64
+	for policy.small.used+policy.main.used+cost > policy.maxCost {
+		e := policy.evictOne()
+		if e == nil {
+			break
+		}
+		out = append(out, e.hashKey)
+		policy.metrics.add(keyEvict, e.hashKey, 1)
+		policy.metrics.add(costEvict, e.hashKey, uint64(e.cost))
+	}
+	return out
+}
+
+// evictOne 淘汰一个 key，两个队列都为空则返回 nil
+func (policy *s3fifoPolicy) evictOne() *entry {
+	for {
+		// 小队列超过了它的容量（或者主队列已经空了），从小队列淘汰
+		if policy.small.len() > 0 && (policy.small.used >= policy.smallMax || policy.main.len() == 0) {
+			e := policy.small.popBack()
+			// 访问过两次以上，移到主队列
+			if e.freq > 1 {
+				e.freq = 0
+				policy.main.pushFront(e)
+				continue
+			}
+			policy.addGhost(e)
+			return e
+		}
+
+		e := policy.main.popBack()
+		if e == nil {
+			return nil
+		}
+		// 访问过，再给一次机会，重新放回队首
+		if e.freq > 0 {
+			e.freq--
+			policy.main.pushFront(e)
+			continue
+		}
+		return e
+	}
+}
+
+// addGhost 幽灵队列的容量和缓存一样，满了则从队尾删除
+func (policy *s3fifoPolicy) addGhost(e *entry) {
+	policy.ghost.remove(e.hashKey)
+	policy.ghost.pushFront(&entry{hashKey: e.hashKey, cost: e.cost})
+	for policy.ghost.used > policy.maxCost {
+		policy.ghost.popBack()
+	}
+}
+
+func (policy *s3fifoPolicy) Del(hashKey uint64) {
+	policy.mutex.Lock()
+	if _, ok := policy.small.remove(hashKey); !ok {
+		policy.main.remove(hashKey)
+	}
+	policy.mutex.Unlock()
+}
+
+func (policy *s3fifoPolicy) Update(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	// 先把自己移出来，这样就不会淘汰自己了
+	list := policy.small
+	e, ok := list.remove(hashKey)
+	if !ok {
+		list = policy.main
+		if e, ok = list.remove(hashKey); !ok {
+			return nil, false
+		}
+	}
+
+	// 超过总容量，只能把自己淘汰
+	if cost > policy.maxCost {
+		return []uint64{hashKey}, true
+	}
+
+	out := policy.evict(cost)
+	// 放回原来的队列，FIFO 不因为更新而改变位置，但移出来后没办法放回原位，只能放到队首
+	e.cost = cost
+	list.pushFront(e)
+	return out, true
+}
+
+func (policy *s3fifoPolicy) Clear() {
+	policy.mutex.Lock()
+	policy.small.clear()
+	policy.main.clear()
+	policy.ghost.clear()
+	policy.mutex.Unlock()
+}
+
+// Frequency 返回 S3-FIFO 记录的访问次数，最多为 3
+func (policy *s3fifoPolicy) Frequency(hashKey uint64) int {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	if e, ok := policy.get(hashKey); ok {
+		return e.freq
+	}
+	return 0
+}
+
+func (policy *s3fifoPolicy) CollectMetrics(metrics *Metrics) {
+	policy.metrics = metrics
+}
+
+func (policy *s3fifoPolicy) Close() {}
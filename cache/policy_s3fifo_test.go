@@ -0,0 +1,45 @@
+package cache
+
+import "testing"
+
+func TestS3FIFOPolicy(t *testing.T) {
+	policy := NewS3FIFOPolicy(0, 10).(*s3fifoPolicy)
+
+	// 小队列容量为 1，热点 key 访问两次后进入主队列
+	policy.Add(1, 1)
+	policy.ConsumeGet([]uint64{1, 1})
+	if out, ok := policy.Add(2, 1); !ok || len(out) != 0 {
+		t.Fatalf("Add 2 failed")
+	}
+
+	// 扫描：一直加入只访问一次的 key，1 不会被淘汰
+	var last uint64
+	for i := uint64(100); i < 200; i++ {
+		out, ok := policy.Add(i, 1)
+		if !ok {
+			t.Fatalf("Add %d failed", i)
+		}
+		for _, k := range out {
+			last = k
+			if k == 1 {
+				t.Fatalf("hot key should not be evicted by scan")
+			}
+		}
+	}
+	if _, ok := policy.main.get(1); !ok {
+		t.Fatalf("hot key should be in main queue")
+	}
+
+	// 最近淘汰的在幽灵队列中，再次加入直接进入主队列
+	if _, ok := policy.ghost.get(last); !ok {
+		t.Fatalf("evicted key should be in ghost queue")
+	}
+	policy.Add(last, 1)
+	if _, ok := policy.main.get(last); !ok {
+		t.Fatalf("ghost key should be added to main queue")
+	}
+
+	if f := policy.Frequency(1); f > s3fifoMaxFreq {
+		t.Fatalf("frequency should not exceed %d", s3fifoMaxFreq)
+	}
+}
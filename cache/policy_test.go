@@ -44,3 +44,122 @@ func TestDefaultPolicy(t *testing.T) {
 		fmt.Println(policy.evict.used)   // 大概率 4
 	}
 }
+
+func TestTinyLFU(t *testing.T) {
+	lfu := newTinyLFU(64)
+
+	// 第一次访问只记录在 doorkeeper 中
+	lfu.incrementFre(1)
+	if lfu.fre.Estimate(1) != 0 || lfu.getFrequent(1) != 1 {
+		t.Fatalf("first access should be absorbed by doorkeeper")
+	}
+	lfu.incrementFre(1)
+	if lfu.fre.Estimate(1) != 1 || lfu.getFrequent(1) != 2 {
+		t.Fatalf("second access should increment sketch")
+	}
+
+	lfu.clear()
+	if lfu.getFrequent(1) != 0 {
+		t.Fatalf("clear failed")
+	}
+
+	// 每 64 次都会保鲜，而不是只有第一次
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 64; i++ {
+			lfu.incrementFre(2)
+		}
+		if lfu.incrs != 0 {
+			t.Fatalf("round %d should reset, incrs %d", round, lfu.incrs)
+		}
+	}
+	if lfu.door.has(2) {
+		t.Fatalf("doorkeeper should be cleared on reset")
+	}
+}
+
+// TestTinyLFU_Restore 恢复的总次数超过 reset 也不会保鲜
+func TestTinyLFU_Restore(t *testing.T) {
+	lfu := newTinyLFU(10000)
+
+	for i := uint64(1); i <= 1000; i++ {
+		lfu.restore(i, 10)
+	}
+	if lfu.incrs != 0 {
+		t.Fatalf("restore should not count incrs, got %d", lfu.incrs)
+	}
+	for i := uint64(1); i <= 1000; i++ {
+		if fre := lfu.getFrequent(i); fre < 10 {
+			t.Fatalf("frequency of %d = %d, want >= 10", i, fre)
+		}
+	}
+}
+
+func TestDefaultPolicy_AdmitByCost(t *testing.T) {
+	byFre := &mockDefaultPolicy{defaultPolicy: newDefaultPolicy(100*10, 100)}
+	byCost := &mockDefaultPolicy{defaultPolicy: NewDefaultPolicyWithAdmission(AdmitByCost)(100*10, 100).(*defaultPolicy)}
+
+	for _, policy := range []*mockDefaultPolicy{byFre, byCost} {
+		// 50 个小的热点 key，访问 2 次
+		for i := uint64(1); i <= 50; i++ {
+			policy.Add(i, 2)
+			policy.ConsumeGet([]uint64{i, i})
+		}
+		// 一个大的 key，频率稍高
+		policy.ConsumeGet([]uint64{100, 100, 100})
+	}
+
+	// 只比较频率，大 key 挤掉了 30 个小 key
+	if out, ok := byFre.Add(100, 60); !ok || len(out) != 30 {
+		t.Fatalf("AdmitByFrequency should admit and evict 30 keys, but %d", len(out))
+	}
+
+	// 比较 频率/cost，3/60 < 2/2，不加入，也不淘汰任何 key
+	if out, ok := byCost.Add(100, 60); ok || len(out) != 0 {
+		t.Fatalf("AdmitByCost should reject big key")
+	}
+	if byCost.evict.used != 100 {
+		t.Fatalf("nothing should be evicted")
+	}
+
+	// 小的新 key 每单位 cost 的频率更高，可以加入
+	byCost.ConsumeGet([]uint64{200, 200, 200})
+	if out, ok := byCost.Add(200, 2); !ok || len(out) != 1 {
+		t.Fatalf("AdmitByCost should admit small hot key")
+	}
+}
+
+func TestDefaultPolicy_EvictionPool(t *testing.T) {
+	policy := &mockDefaultPolicy{
+		defaultPolicy: NewDefaultPolicyWithOptions(PolicyOptionSampleSize(2))(100*10, 100).(*defaultPolicy),
+	}
+	if policy.sampleSize != 2 {
+		t.Fatalf("sample size should be 2")
+	}
+
+	// 1 个冷 key，其他都访问过
+	for i := uint64(1); i <= 100; i++ {
+		policy.Add(i, 1)
+		if i != 50 {
+			policy.ConsumeGet([]uint64{i, i, i})
+		}
+	}
+
+	// 每次只采样 2 个，但淘汰池会保留之前的候选者，多淘汰几次总能找到冷 key
+	policy.ConsumeGet([]uint64{1000, 1000, 1000, 1000})
+	var evicted bool
+	for i := uint64(1000); i < 2000 && !evicted; i++ {
+		policy.ConsumeGet([]uint64{i, i, i, i})
+		out, _ := policy.Add(i, 1)
+		for _, k := range out {
+			if k == 50 {
+				evicted = true
+			}
+		}
+	}
+	if !evicted {
+		t.Fatalf("cold key should be evicted")
+	}
+	if len(policy.evict.keys) != len(policy.evict.keyCosts) {
+		t.Fatalf("keys and keyCosts should be consistent")
+	}
+}
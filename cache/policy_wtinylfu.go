@@ -0,0 +1,308 @@
+package cache
+
+import "sync"
+
+const (
+	// 窗口初始占总容量的 1%
+	wtinylfuWindowPercent = 0.01
+	// 爬山法调整窗口时，窗口最多占总容量的 80%
+	wtinylfuMaxWindowPercent = 0.8
+	// 保护区占主区的 80%
+	wtinylfuProtectedPercent = 0.8
+	// 爬山法初始步长为总容量的 6.25%，每次调整后衰减
+	wtinylfuStepPercent = 0.0625
+	wtinylfuStepDecay   = 0.98
+)
+
+// wtinylfuPolicy W-TinyLFU（同 Caffeine）
+// 新的 key 先进入窗口（LRU），不经过准入策略，所以突发的新 key 不会因为没有历史频率被直接拒绝
+// 从窗口淘汰的 key 作为候选者，和主区（分段 LRU：试用区 + 保护区）的淘汰者比较 TinyLFU 估计的频率，频率高的才留下
+// 主区中试用区的 key 被访问后进入保护区，保护区满了则把最久没访问的降级回试用区
+// 窗口的大小用爬山法调整：每隔一段时间比较命中率，命中率提高则继续往同一个方向调整，否则反方向调整
+type wtinylfuPolicy struct {
+	mutex     sync.Mutex
+	maxCost   int64
+	admit     *tinyLFU
+	window    *costList
+	probation *costList
+	protected *costList
+	windowMax int64
+	// 爬山法
+	// 每 sampleSize 次 Get 调整一次
+	sampleSize int64
+	hits       int64
+	misses     int64
+	// 上一次的命中率
+	prevHitRate float64
+	// 每次调整窗口的大小，正数表示增大，负数表示减小
+	step    float64
+	metrics *Metrics
+}
+
+// NewWTinyLFUPolicy numCount 为 TinyLFU 计数器的数量，同时也是爬山法的采样周期（多少次 Get 调整一次窗口）
+func NewWTinyLFUPolicy(numCount, maxCost int64) Policy {
+	windowMax := int64(float64(maxCost) * wtinylfuWindowPercent)
+	if windowMax == 0 {
+		windowMax = 1
+	}
+	return &wtinylfuPolicy{
+		maxCost:    maxCost,
+		admit:      newTinyLFU(numCount),
+		window:     newCostList(),
+		probation:  newCostList(),
+		protected:  newCostList(),
+		windowMax:  windowMax,
+		sampleSize: numCount,
+		step:       float64(maxCost) * wtinylfuStepPercent,
+	}
+}
+
+func (policy *wtinylfuPolicy) mainMax() int64 {
+	return policy.maxCost - policy.windowMax
+}
+
+func (policy *wtinylfuPolicy) protectedMax() int64 {
+	return int64(float64(policy.mainMax()) * wtinylfuProtectedPercent)
+}
+
+// ConsumeGet 增加频率并调整位置，都很快，所以直接上锁同步处理
+func (policy *wtinylfuPolicy) ConsumeGet(hashKeys []uint64) bool {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	for i := range hashKeys {
+		hashKey := hashKeys[i]
+		policy.admit.incrementFre(hashKey)
+
+		switch {
+		case policy.window.moveToFront(hashKey):
+		case policy.protected.moveToFront(hashKey):
+		default:
+			// 试用区被访问，进入保护区
+			e, ok := policy.probation.remove(hashKey)
+			if !ok {
+				policy.misses++
+				continue
+			}
+			policy.protected.pushFront(e)
+			policy.demote()
+		}
+		policy.hits++
+	}
+
+	policy.climb()
+	return true
+}
+
+// demote 保护区满了，把最久没访问的降级回试用区，调用方需要上锁
+func (policy *wtinylfuPolicy) demote() {
+	for policy.protected.used > policy.protectedMax() {
+		policy.probation.pushFront(policy.protected.popBack())
+	}
+}
+
+// climb 爬山法调整窗口的大小，调用方需要上锁
+func (policy *wtinylfuPolicy) climb() {
+	if policy.sampleSize <= 0 || policy.hits+policy.misses < policy.sampleSize {
+		return
+	}
+
+	hitRate := float64(policy.hits) / float64(policy.hits+policy.misses)
+	// 命中率下降了，说明方向不对，反方向调整
+	if hitRate < policy.prevHitRate {
+		policy.step = -policy.step
+	}
+	policy.prevHitRate = hitRate
+	policy.hits, policy.misses = 0, 0
+
+	windowMax := policy.windowMax + int64(policy.step)
+	if windowMax < 1 {
+		windowMax = 1
+	}
+	if limit := int64(float64(policy.maxCost) * wtinylfuMaxWindowPercent); windowMax > limit && limit >= 1 {
+		windowMax = limit
+	}
+	policy.windowMax = windowMax
+	policy.step *= wtinylfuStepDecay
+	// 窗口和主区的 key 等到下次 Add 时再按照新的大小移动和淘汰
+}
+
+func (policy *wtinylfuPolicy) Add(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	if cost > policy.maxCost {
+		return nil, false
+	}
+	if _, ok := policy.get(hashKey); ok {
+		return nil, false
+	}
+
+	policy.window.pushFront(&entry{hashKey: hashKey, cost: cost})
+	out := policy.evict()
+
+	// 自己从窗口出来后就被淘汰了
+	for i := range out {
+		if out[i] == hashKey {
+			out[i] = out[len(out)-1]
+			return out[:len(out)-1], false
+		}
+	}
+	return out, true
+}
+
+// get 调用方需要上锁
+func (policy *wtinylfuPolicy) get(hashKey uint64) (*entry, bool) {
+	if e, ok := policy.window.get(hashKey); ok {
+		return e, true
+	}
+	if e, ok := policy.probation.get(hashKey); ok {
+		return e, true
+	}
+	return policy.protected.get(hashKey)
+}
+
+// evict 窗口超出的 key 作为候选者进入主区，主区放不下则和淘汰者比较频率，调用方需要上锁
+func (policy *wtinylfuPolicy) evict() []uint64 {
+	var out []uint64
+	for policy.window.used > policy.windowMax {
+		candidate := policy.window.popBack()
+		candidateFre := policy.admit.getFrequent(candidate.hashKey)
+
+		admitted := true
+		for policy.probation.used+policy.protected.used+candidate.cost > policy.mainMax() {
+			victim := policy.probation.back()
+			if victim == nil {
+				victim = policy.protected.back()
+			}
+			if victim == nil {
+				break
+			}
+			// 频率不比淘汰者高，淘汰候选者
+			if candidateFre <= policy.admit.getFrequent(victim.hashKey) {
+				admitted = false
+				break
+			}
+			if _, ok := policy.probation.remove(victim.hashKey); !ok {
+				policy.protected.remove(victim.hashKey)
+			}
+			out = policy.evicted(out, victim)
+		}
+
+		if admitted && policy.probation.used+policy.protected.used+candidate.cost <= policy.mainMax() {
+			policy.probation.pushFront(candidate)
+		} else {
+			out = policy.evicted(out, candidate)
+		}
+	}
+
+	// 爬山法增大了窗口，主区变小了，直接淘汰多出来的
+	for policy.probation.used+policy.protected.used > policy.mainMax() {
+		victim := policy.probation.popBack()
+		if victim == nil {
+			victim = policy.protected.popBack()
+		}
+		out = policy.evicted(out, victim)
+	}
+	policy.demote()
+
+	return out
+}
+
+func (policy *wtinylfuPolicy) evicted(out []uint64, e *entry) []uint64 {
+	policy.metrics.add(keyEvict, e.hashKey, 1)
+	policy.metrics.add(costEvict, e.hashKey, uint64(e.cost))
+	return append(out, e.hashKey)
+}
+
+func (policy *wtinylfuPolicy) Del(hashKey uint64) {
+	policy.mutex.Lock()
+	policy.remove(hashKey)
+	policy.mutex.Unlock()
+}
+
+// remove 返回 key 所在的链表，调用方需要上锁
+func (policy *wtinylfuPolicy) remove(hashKey uint64) (*costList, *entry, bool) {
+	for _, list := range []*costList{policy.window, policy.probation, policy.protected} {
+		if e, ok := list.remove(hashKey); ok {
+			return list, e, true
+		}
+	}
+	return nil, nil, false
+}
+
+func (policy *wtinylfuPolicy) Update(hashKey uint64, cost int64) ([]uint64, bool) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	// 先把自己移出来，这样就不会淘汰自己了
+	list, e, ok := policy.remove(hashKey)
+	if !ok {
+		return nil, false
+	}
+
+	// 超过总容量，只能把自己淘汰
+	if cost > policy.maxCost {
+		return []uint64{hashKey}, true
+	}
+
+	// 已经在缓存中了，所以不需要再经过准入策略，从试用区、保护区、窗口依次淘汰
+	var out []uint64
+	for policy.window.used+policy.probation.used+policy.protected.used+cost > policy.maxCost {
+		victim := policy.probation.popBack()
+		if victim == nil {
+			victim = policy.protected.popBack()
+		}
+		if victim == nil {
+			victim = policy.window.popBack()
+		}
+		if victim == nil {
+			break
+		}
+		out = policy.evicted(out, victim)
+	}
+
+	e.cost = cost
+	list.pushFront(e)
+	policy.demote()
+	return out, true
+}
+
+func (policy *wtinylfuPolicy) Clear() {
+	policy.mutex.Lock()
+	policy.admit.clear()
+	policy.window.clear()
+	policy.probation.clear()
+	policy.protected.clear()
+	policy.mutex.Unlock()
+}
+
+func (policy *wtinylfuPolicy) Frequency(hashKey uint64) int {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	return policy.admit.getFrequent(hashKey)
+}
+
+func (policy *wtinylfuPolicy) restoreFrequency(hashKey uint64, fre int) {
+	policy.mutex.Lock()
+	policy.admit.restore(hashKey, fre)
+	policy.mutex.Unlock()
+}
+
+func (policy *wtinylfuPolicy) copySketch() *tinyLFU {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	return cloneTinyLFU(policy.admit)
+}
+
+func (policy *wtinylfuPolicy) replaceSketch(s *tinyLFU) bool {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	return policy.admit.replace(s)
+}
+
+func (policy *wtinylfuPolicy) CollectMetrics(metrics *Metrics) {
+	policy.metrics = metrics
+}
+
+func (policy *wtinylfuPolicy) Close() {}
@@ -0,0 +1,58 @@
+package cache
+
+import "testing"
+
+func TestWTinyLFUPolicy(t *testing.T) {
+	policy := NewWTinyLFUPolicy(100*10, 100).(*wtinylfuPolicy)
+
+	for i := uint64(1); i <= 100; i++ {
+		if _, ok := policy.Add(i, 1); !ok {
+			t.Fatalf("Add %d failed", i)
+		}
+	}
+
+	// 新的 key 没有历史频率也能进入窗口，被淘汰的是从窗口出来的候选者
+	if out, ok := policy.Add(101, 1); !ok || len(out) != 1 || out[0] == 101 {
+		t.Fatalf("new key should be admitted into window, but %v", out)
+	}
+	if _, ok := policy.window.get(101); !ok {
+		t.Fatalf("101 should be in window")
+	}
+
+	// 试用区的 key 被访问后进入保护区
+	policy.ConsumeGet([]uint64{1})
+	if _, ok := policy.protected.get(1); !ok {
+		t.Fatalf("1 should be promoted to protected")
+	}
+
+	// 热点 key 从窗口出来后能挤掉主区的冷 key
+	policy.ConsumeGet([]uint64{102, 102, 102})
+	policy.Add(102, 1)
+	policy.Add(103, 1)
+	if _, ok := policy.probation.get(102); !ok {
+		t.Fatalf("hot candidate 102 should be admitted into probation")
+	}
+
+	if used := policy.window.used + policy.probation.used + policy.protected.used; used > 100 {
+		t.Fatalf("used %d should not exceed max cost", used)
+	}
+}
+
+func TestWTinyLFUPolicy_Climb(t *testing.T) {
+	policy := NewWTinyLFUPolicy(10, 100).(*wtinylfuPolicy)
+	policy.Add(1, 1)
+
+	// 第一次采样命中率比初始的 0 高，继续增大窗口
+	windowMax := policy.windowMax
+	policy.ConsumeGet([]uint64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
+	if policy.windowMax <= windowMax {
+		t.Fatalf("window should grow, %d -> %d", windowMax, policy.windowMax)
+	}
+
+	// 命中率下降，反方向调整
+	windowMax = policy.windowMax
+	policy.ConsumeGet([]uint64{2, 2, 2, 2, 2, 2, 2, 2, 2, 2})
+	if policy.windowMax >= windowMax {
+		t.Fatalf("window should shrink, %d -> %d", windowMax, policy.windowMax)
+	}
+}
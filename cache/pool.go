@@ -0,0 +1,73 @@
+package cache
+
+const (
+	// evictionPoolSize 同 Redis 的 EVPOOL_SIZE
+	evictionPoolSize = 16
+)
+
+type poolItem struct {
+	hashKey uint64
+	cost    int64
+	// 加入淘汰池时估计的频率
+	fre int64
+}
+
+// evictionPool 淘汰池（同 Redis 的 evictionPoolPopulate），按照从最应该淘汰到最不应该淘汰排序，最多保留 evictionPoolSize 个候选者
+// 以前每次淘汰都重新采样 5 个 key，没被选中的候选者就直接丢弃了，而淘汰池会把它们留到下次，和新的采样一起比较
+// 这样相同的采样次数（CPU 开销）下，淘汰的质量更接近真正的 LFU
+type evictionPool struct {
+	items []poolItem
+}
+
+func newEvictionPool() *evictionPool {
+	return &evictionPool{
+		items: make([]poolItem, 0, evictionPoolSize+1),
+	}
+}
+
+// push 按照 less 插入到合适的位置，已经在池中则忽略，满了则丢弃最不应该淘汰的
+func (pool *evictionPool) push(item poolItem, less func(a, b poolItem) bool) {
+	for i := range pool.items {
+		if pool.items[i].hashKey == item.hashKey {
+			return
+		}
+	}
+
+	// 池满了且比最后一个还不应该淘汰，不用加入
+	if len(pool.items) >= evictionPoolSize && !less(item, pool.items[len(pool.items)-1]) {
+		return
+	}
+
+	i := len(pool.items)
+	for i > 0 && less(item, pool.items[i-1]) {
+		i--
+	}
+	pool.items = append(pool.items, poolItem{})
+	copy(pool.items[i+1:], pool.items[i:])
+	pool.items[i] = item
+
+	if len(pool.items) > evictionPoolSize {
+		pool.items = pool.items[:evictionPoolSize]
+	}
+}
+
+// pop 取出第一个 valid 的候选者，排在它前面 valid 返回 false 的（例如已经被删除了）也一并移出池
+func (pool *evictionPool) pop(valid func(item poolItem) bool) (poolItem, bool) {
+	kept := pool.items[:0]
+	var result poolItem
+	var found bool
+	for _, item := range pool.items {
+		switch {
+		case found:
+			kept = append(kept, item)
+		case valid(item):
+			result, found = item, true
+		}
+	}
+	pool.items = kept
+	return result, found
+}
+
+func (pool *evictionPool) clear() {
+	pool.items = pool.items[:0]
+}
@@ -0,0 +1,36 @@
+package cache
+
+import "testing"
+
+func TestEvictionPool(t *testing.T) {
+	pool := newEvictionPool()
+	less := func(a, b poolItem) bool { return a.fre < b.fre }
+
+	// 超过容量，只保留频率最小的 evictionPoolSize 个
+	for i := 0; i < 2*evictionPoolSize; i++ {
+		pool.push(poolItem{hashKey: uint64(i), cost: 1, fre: int64(2*evictionPoolSize - i)}, less)
+	}
+	pool.push(poolItem{hashKey: 2*evictionPoolSize - 1, fre: 1}, less)
+	if len(pool.items) != evictionPoolSize {
+		t.Fatalf("pool size should be %d, but %d", evictionPoolSize, len(pool.items))
+	}
+	for i := 1; i < len(pool.items); i++ {
+		if less(pool.items[i], pool.items[i-1]) {
+			t.Fatalf("pool should be sorted")
+		}
+	}
+
+	// 跳过失效的，并把它们移出池
+	item, ok := pool.pop(func(item poolItem) bool { return item.hashKey != 2*evictionPoolSize-1 })
+	if !ok || item.hashKey != 2*evictionPoolSize-2 {
+		t.Fatalf("pop wrong item %d", item.hashKey)
+	}
+	if len(pool.items) != evictionPoolSize-2 {
+		t.Fatalf("invalid item should be removed")
+	}
+
+	pool.clear()
+	if _, ok := pool.pop(func(poolItem) bool { return true }); ok {
+		t.Fatalf("clear failed")
+	}
+}
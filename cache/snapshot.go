@@ -0,0 +1,343 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	// snapshotMagic 文件开头的 4 个字节，用来识别是不是快照文件
+	snapshotMagic = "AYCS"
+	// snapshotVersion 格式改变时加 1，Load 只认识自己版本的格式
+	// 2：增加了 TinyLFU 和每个 key 的滑动过期时间
+	snapshotVersion uint16 = 2
+
+	// snapshotHasSketch 版本号后面的标志，表示接着是整个 TinyLFU
+	snapshotHasSketch byte = 1
+
+	// 每条记录前面的标志，最后以 snapshotEnd 结束，这样文件被截断了也能发现
+	snapshotEntry byte = 1
+	snapshotEnd   byte = 0
+
+	// maxSnapshotBytes 一个 key 或 value 最大 1GB
+	maxSnapshotBytes = 1 << 30
+)
+
+var (
+	errKeysNotKept  = errors.New("snapshot needs OptionKeepKeys")
+	errBadSnapshot  = errors.New("not a cache snapshot")
+	errBadVersion   = errors.New("unsupported snapshot version")
+	errBadEntryFlag = errors.New("bad snapshot entry flag")
+)
+
+// SnapshotCodec 快照中 key 和 value 的编码方式，缓存本身不知道 K 和 V 怎么序列化，由调用方提供
+type SnapshotCodec[K any, V any] struct {
+	EncodeKey   func(key K) ([]byte, error)
+	DecodeKey   func(b []byte) (K, error)
+	EncodeValue func(value V) ([]byte, error)
+	DecodeValue func(b []byte) (V, error)
+}
+
+// frequencyRestorer 能恢复频率的 policy（基于 TinyLFU 的），LoadSnapshot 时用于恢复快照中记录的频率或者整个 TinyLFU
+// 不放在 Policy 中，这样自定义的 Policy 不需要实现它
+type frequencyRestorer interface {
+	restoreFrequency(hashKey uint64, fre int)
+	// copySketch 复制整个 TinyLFU
+	copySketch() *tinyLFU
+	// replaceSketch 大小一样时替换整个 TinyLFU，否则返回 false
+	replaceSketch(s *tinyLFU) bool
+}
+
+// SaveSnapshot 把所有未过期的 key 写入 w，keep 不为 nil 时只写入 keep 返回 true 的 key
+// 格式：magic、版本号、标志，标志包含 snapshotHasSketch 时接着是整个 TinyLFU（计数器、种子、doorkeeper），
+// 然后每个 key 一条记录：key、value、cost、过期时间（unix 纳秒，0 表示不过期）、滑动过期时间（纳秒）、估计的频率，最后是结束标志
+// TinyLFU 的计数器是按 hash 索引的，只有开启了 OptionStableHash 才保存，默认的 memHash 每个进程的种子都不一样，
+// 重启后原来的计数器对不上新的 hash。此时只能用每个 key 的频率恢复，不在缓存中的 key 的频率就丢失了
+// 需要开启 OptionKeepKeys，否则拿不到原始的 key
+func (c *typedCache[K, V]) SaveSnapshot(w io.Writer, codec SnapshotCodec[K, V], keep func(key K) bool) error {
+	if !c.keepKeys {
+		return errKeysNotKept
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.BigEndian, snapshotVersion); err != nil {
+		return err
+	}
+
+	restorer, _ := c.policy.(frequencyRestorer)
+	if c.stableHash && restorer != nil {
+		if err := bw.WriteByte(snapshotHasSketch); err != nil {
+			return err
+		}
+		if err := writeSketch(bw, restorer.copySketch()); err != nil {
+			return err
+		}
+	} else if err := bw.WriteByte(0); err != nil {
+		return err
+	}
+
+	// 同 Range，但还需要滑动过期时间
+	for shard := 0; shard < c.store.Shards(); shard++ {
+		items := c.store.Snapshot(shard)
+		for i := range items {
+			key, _ := items[i].key.(K)
+			if keep != nil && !keep(key) {
+				continue
+			}
+			if err := c.writeEntry(bw, codec, key, &items[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := bw.WriteByte(snapshotEnd); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (c *typedCache[K, V]) writeEntry(w *bufio.Writer, codec SnapshotCodec[K, V], key K, item *storeItem[V]) error {
+	k, err := codec.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	v, err := codec.EncodeValue(item.value)
+	if err != nil {
+		return err
+	}
+
+	var exp int64
+	if !item.expiration.IsZero() {
+		exp = item.expiration.UnixNano()
+	}
+
+	buf := make([]byte, 0, 1+len(k)+len(v)+6*binary.MaxVarintLen64)
+	buf = append(buf, snapshotEntry)
+	buf = binary.AppendUvarint(buf, uint64(len(k)))
+	buf = append(buf, k...)
+	buf = binary.AppendUvarint(buf, uint64(len(v)))
+	buf = append(buf, v...)
+	buf = binary.AppendVarint(buf, item.cost)
+	buf = binary.AppendVarint(buf, exp)
+	buf = binary.AppendVarint(buf, int64(item.sliding))
+	buf = binary.AppendUvarint(buf, uint64(c.policy.Frequency(item.hashKey)))
+	_, err = w.Write(buf)
+	return err
+}
+
+// writeSketch 计数器的数量、doorkeeper 的位数（uint64 的个数）、incrs、reset、4 个种子，然后是每一行的计数器和 doorkeeper
+func writeSketch(w *bufio.Writer, s *tinyLFU) error {
+	buf := make([]byte, 0, 4*binary.MaxVarintLen64+8*cmDepth)
+	buf = binary.AppendUvarint(buf, s.fre.mask+1)
+	buf = binary.AppendUvarint(buf, uint64(len(s.door.bits)))
+	buf = binary.AppendVarint(buf, s.incrs)
+	buf = binary.AppendVarint(buf, s.reset)
+	for _, seed := range s.fre.seed {
+		buf = binary.BigEndian.AppendUint64(buf, seed)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	for _, row := range s.fre.rows {
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	var b [8]byte
+	for _, bits := range s.door.bits {
+		binary.BigEndian.PutUint64(b[:], bits)
+		if _, err := w.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSketch(r *bufio.Reader) (*tinyLFU, error) {
+	counters, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	words, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// 文件损坏时大小可能非常大，不要直接分配
+	if counters < 2 || counters&(counters-1) != 0 || counters/2 > maxSnapshotBytes || words == 0 || words&(words-1) != 0 || words*8 > maxSnapshotBytes {
+		return nil, errBadSnapshot
+	}
+	s := &tinyLFU{
+		fre:  &cmSketch{mask: counters - 1},
+		door: &bloom{bits: make([]uint64, words), mask: words*64 - 1},
+	}
+	if s.incrs, err = binary.ReadVarint(r); err != nil {
+		return nil, err
+	}
+	if s.reset, err = binary.ReadVarint(r); err != nil {
+		return nil, err
+	}
+
+	var b [8]byte
+	for i := range s.fre.seed {
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		s.fre.seed[i] = binary.BigEndian.Uint64(b[:])
+	}
+	for i := range s.fre.rows {
+		s.fre.rows[i] = make(cmRow, counters/2)
+		if _, err = io.ReadFull(r, s.fre.rows[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range s.door.bits {
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		s.door.bits[i] = binary.BigEndian.Uint64(b[:])
+	}
+	return s, nil
+}
+
+// LoadSnapshot 读取 SaveSnapshot 写入的快照并加入缓存，返回加入的 key 的数量
+// key 重新计算 hash，先恢复频率再加入，所以仍然要经过准入策略，已经存在的 key 不会被覆盖，已经过期的 key 直接跳过
+// 快照中有 TinyLFU、本缓存开启了 OptionStableHash 并且 numCount 没变时，直接替换整个 TinyLFU，否则恢复每个 key 的频率
+// 滑动过期的 key 恢复后仍然是滑动过期的（和本缓存是否开启 OptionSlidingTTL 无关），剩余时间为保存时的剩余时间
+// 返回时所有的 key 都已经处理完了（同 Wait）
+func (c *typedCache[K, V]) LoadSnapshot(r io.Reader, codec SnapshotCodec[K, V]) (int, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return 0, err
+	}
+	if string(magic) != snapshotMagic {
+		return 0, errBadSnapshot
+	}
+	var version uint16
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return 0, err
+	}
+	if version != snapshotVersion {
+		return 0, errBadVersion
+	}
+
+	restorer, _ := c.policy.(frequencyRestorer)
+	flags, err := br.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	sketchRestored := false
+	if flags&snapshotHasSketch != 0 {
+		s, err := readSketch(br)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if c.stableHash && restorer != nil {
+			sketchRestored = restorer.replaceSketch(s)
+		}
+	}
+
+	n := 0
+	for {
+		flag, err := br.ReadByte()
+		if err != nil {
+			return n, unexpectedEOF(err)
+		}
+		if flag == snapshotEnd {
+			break
+		}
+		if flag != snapshotEntry {
+			return n, errBadEntryFlag
+		}
+
+		key, value, cost, expiration, sliding, fre, err := readEntry(br, codec)
+		if err != nil {
+			return n, unexpectedEOF(err)
+		}
+
+		var ttl time.Duration
+		if expiration != 0 {
+			if ttl = time.Unix(0, expiration).Sub(c.clock.Now()); ttl <= 0 {
+				continue
+			}
+		}
+
+		i, ok := c.newItem(key, value, cost, ttl)
+		if !ok {
+			continue
+		}
+		if ttl > 0 {
+			i.sliding = time.Duration(sliding)
+		}
+		if restorer != nil && !sketchRestored {
+			restorer.restoreFrequency(i.hashKey, fre)
+		}
+		if !c.pushWait(i) {
+			return n, nil
+		}
+		n++
+	}
+
+	c.Wait()
+	return n, nil
+}
+
+func readEntry[K any, V any](r *bufio.Reader, codec SnapshotCodec[K, V]) (key K, value V, cost, expiration, sliding int64, fre int, err error) {
+	k, err := readBytes(r)
+	if err != nil {
+		return
+	}
+	v, err := readBytes(r)
+	if err != nil {
+		return
+	}
+	if cost, err = binary.ReadVarint(r); err != nil {
+		return
+	}
+	if expiration, err = binary.ReadVarint(r); err != nil {
+		return
+	}
+	if sliding, err = binary.ReadVarint(r); err != nil {
+		return
+	}
+	f, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	fre = int(f)
+
+	if key, err = codec.DecodeKey(k); err != nil {
+		return
+	}
+	value, err = codec.DecodeValue(v)
+	return
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// 文件损坏时长度可能非常大，不要直接分配
+	if n > maxSnapshotBytes {
+		return nil, errBadSnapshot
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// unexpectedEOF 还没读到结束标志就没有了，说明文件被截断了
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
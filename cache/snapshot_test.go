@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
+)
+
+var stringCodec = SnapshotCodec[string, int]{
+	EncodeKey: func(key string) ([]byte, error) {
+		return []byte(key), nil
+	},
+	DecodeKey: func(b []byte) (string, error) {
+		return string(b), nil
+	},
+	EncodeValue: func(value int) ([]byte, error) {
+		return []byte(strconv.Itoa(value)), nil
+	},
+	DecodeValue: func(b []byte) (int, error) {
+		return strconv.Atoi(string(b))
+	},
+}
+
+func TestSnapshot(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := New[string, int](1000, 100, OptionKeepKeys(), OptionClock(clk), OptionRingBufferSize(1))
+	defer c.Close()
+
+	c.Add("ayang", 1, 1)
+	c.AddWithTTL("tom", 2, 2, time.Minute)
+	c.AddWithTTL("short", 3, 1, time.Second)
+	c.Add("skip", 4, 1)
+	c.Wait()
+	for i := 0; i < 5; i++ {
+		c.Get("ayang")
+		time.Sleep(time.Millisecond)
+	}
+	fre := c.Frequency("ayang")
+
+	buf := &bytes.Buffer{}
+	if err := c.SaveSnapshot(buf, stringCodec, func(key string) bool { return key != "skip" }); err != nil {
+		t.Fatalf("SaveSnapshot failed: %s", err.Error())
+	}
+	data := buf.Bytes()
+
+	// short 在恢复前过期了
+	clk.Add(2 * time.Second)
+	c2 := New[string, int](1000, 100, OptionClock(clk))
+	defer c2.Close()
+	n, err := c2.LoadSnapshot(bytes.NewReader(data), stringCodec)
+	if err != nil || n != 2 {
+		t.Fatalf("LoadSnapshot = %d, %v, want 2", n, err)
+	}
+
+	if v, ok := c2.Get("ayang"); !ok || v != 1 {
+		t.Fatalf("ayang = %v, %v", v, ok)
+	}
+	if v, ok := c2.Get("tom"); !ok || v != 2 {
+		t.Fatalf("tom = %v, %v", v, ok)
+	}
+	if ttl, _ := c2.GetTTL("tom"); ttl != 58*time.Second {
+		t.Fatalf("tom ttl = %v, want 58s", ttl)
+	}
+	for _, key := range []string{"short", "skip"} {
+		if _, ok := c2.Get(key); ok {
+			t.Fatalf("%s should not be restored", key)
+		}
+	}
+	if got := c2.Frequency("ayang"); got < fre {
+		t.Fatalf("frequency = %d, want at least %d", got, fre)
+	}
+
+	// 截断的文件
+	if _, err = c2.LoadSnapshot(bytes.NewReader(data[:len(data)-1]), stringCodec); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated snapshot err = %v", err)
+	}
+	if _, err = c2.LoadSnapshot(bytes.NewReader([]byte("nope!!")), stringCodec); err != errBadSnapshot {
+		t.Fatalf("bad magic err = %v", err)
+	}
+	if err = c2.SaveSnapshot(buf, stringCodec, nil); err != errKeysNotKept {
+		t.Fatalf("SaveSnapshot without OptionKeepKeys err = %v", err)
+	}
+}
+
+func TestSnapshot_Sliding(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	c := New[string, int](1000, 100, OptionKeepKeys(), OptionClock(clk), OptionSlidingTTL())
+	defer c.Close()
+
+	c.AddWithTTL("ayang", 1, 1, time.Minute)
+	c.Wait()
+
+	buf := &bytes.Buffer{}
+	if err := c.SaveSnapshot(buf, stringCodec, nil); err != nil {
+		t.Fatalf("SaveSnapshot failed: %s", err.Error())
+	}
+
+	// 恢复的缓存没有开启 OptionSlidingTTL，ayang 仍然是滑动过期的
+	clk.Add(10 * time.Second)
+	c2 := New[string, int](1000, 100, OptionClock(clk))
+	defer c2.Close()
+	if n, err := c2.LoadSnapshot(buf, stringCodec); err != nil || n != 1 {
+		t.Fatalf("LoadSnapshot = %d, %v, want 1", n, err)
+	}
+	if ttl, _ := c2.GetTTL("ayang"); ttl != 50*time.Second {
+		t.Fatalf("ttl = %v, want 50s", ttl)
+	}
+
+	clk.Add(20 * time.Second)
+	if v, ok := c2.Get("ayang"); !ok || v != 1 {
+		t.Fatalf("ayang = %v, %v", v, ok)
+	}
+	if ttl, _ := c2.GetTTL("ayang"); ttl != time.Minute {
+		t.Fatalf("ttl after Get = %v, want 1m", ttl)
+	}
+}
+
+func TestSnapshot_Sketch(t *testing.T) {
+	c := New[string, int](1000, 100, OptionKeepKeys(), OptionStableHash(), OptionRingBufferSize(1))
+	defer c.Close()
+
+	c.Add("ayang", 1, 1)
+	c.Wait()
+	// ghost 不在缓存中，只有 TinyLFU 中有它的频率
+	for i := 0; i < 5; i++ {
+		c.Get("ghost")
+		time.Sleep(time.Millisecond)
+	}
+	fre := c.Frequency("ghost")
+	if fre == 0 {
+		t.Fatal("ghost should have frequency")
+	}
+
+	buf := &bytes.Buffer{}
+	if err := c.SaveSnapshot(buf, stringCodec, nil); err != nil {
+		t.Fatalf("SaveSnapshot failed: %s", err.Error())
+	}
+	data := buf.Bytes()
+
+	c2 := New[string, int](1000, 100, OptionStableHash())
+	defer c2.Close()
+	if n, err := c2.LoadSnapshot(bytes.NewReader(data), stringCodec); err != nil || n != 1 {
+		t.Fatalf("LoadSnapshot = %d, %v, want 1", n, err)
+	}
+	if got := c2.Frequency("ghost"); got != fre {
+		t.Fatalf("ghost frequency = %d, want %d", got, fre)
+	}
+
+	// 没有开启 OptionStableHash 时 hash 对不上，跳过 TinyLFU，只恢复每个 key 的频率
+	c3 := New[string, int](1000, 100)
+	defer c3.Close()
+	if n, err := c3.LoadSnapshot(bytes.NewReader(data), stringCodec); err != nil || n != 1 {
+		t.Fatalf("LoadSnapshot = %d, %v, want 1", n, err)
+	}
+	if got := c3.Frequency("ghost"); got != 0 {
+		t.Fatalf("ghost frequency = %d, want 0", got)
+	}
+	if _, ok := c3.Get("ayang"); !ok {
+		t.Fatal("ayang should be restored")
+	}
+}
@@ -1,120 +1,325 @@
 package cache
 
 import (
+	"runtime"
 	"sync"
 	"time"
-)
 
-const (
-	concurrentMapSize = 256
+	"github.com/ayanghuang/ayangcache/clock"
 )
 
-type store interface {
-	Get(uint64, uint64) (interface{}, bool)
-	Add(uint64, uint64, interface{}, time.Time) bool
-	Del(uint64, uint64) (interface{}, bool)
+// shardsPerProc 默认每个 P 16 个分段，并发的 goroutine 越多，分段也要越多，才能减少争用
+const shardsPerProc = 16
+
+// defaultShards 默认的分段数量，GOMAXPROCS 的倍数，见 OptionShards
+func defaultShards() int {
+	return runtime.GOMAXPROCS(0) * shardsPerProc
 }
 
-type storeItem struct {
-	hashKey    uint64
-	conflict   uint64
-	value      interface{}
+type store[V any] interface {
+	// Get 发现已过期则直接删除，并通过 onExpire 通知调用方
+	Get(uint64, uint64) (V, bool)
+	// GetItem 同 Get，但返回完整的 item（滑动过期延长之后的），value 和其他字段是同一次加锁读取的
+	GetItem(hashKey, conflict uint64) (storeItem[V], bool)
+	// Peek 同 Get，但不会延长滑动过期时间，也不会删除已过期的 item，返回完整的 item
+	Peek(hashKey, conflict uint64) (storeItem[V], bool)
+	// Add 不存在（或已过期）才加入，created 由 store 设置为当前时间
+	// 参数太多了，所以直接传 storeItem
+	Add(item storeItem[V]) bool
+	// Update 存在（且未过期）才更新 value、cost、过期时间，created 不变，返回旧的 item
+	Update(item storeItem[V]) (storeItem[V], bool)
+	// Expiration 返回过期时间，不存在（或已过期）返回 false，为零值表示不会过期
+	Expiration(hashKey, conflict uint64) (time.Time, bool)
+	// Touch 存在（且未过期）才修改过期时间，value 不变，返回旧的 item
+	Touch(hashKey, conflict uint64, expiration time.Time, sliding time.Duration) (storeItem[V], bool)
+	// Del 返回被删除的 item，调用方需要根据它的过期时间从 expiration 中删除
+	Del(uint64, uint64) (storeItem[V], bool)
+	// Clear 删除全部
+	Clear()
+	// Shards 分段的数量
+	Shards() int
+	// Snapshot 返回第 shard 个分段中所有未过期的 item 的副本，同一个分段内是一致的（加锁复制）
+	Snapshot(shard int) []storeItem[V]
+}
+
+type storeItem[V any] struct {
+	hashKey  uint64
+	conflict uint64
+	// key 原始的 key，只有开启了 OptionKeepKeys 才保存，用于遍历
+	key   interface{}
+	value V
+	cost  int64
+	// created 加入的时间，Update 不会修改
+	created    time.Time
 	expiration time.Time
+	// sliding 滑动过期，每次 Get 都把过期时间延长到 now + sliding，为 0 表示不滑动
+	// 只修改 storeItem，不修改 expiration（时间轮），定期清理时发现还没过期再放回时间轮
+	sliding time.Duration
 }
 
-// shareStore 使用分段锁实现，即 256 个 map 分别拥有锁，以确保对 shareStore 尽可能高的并行访问
-type shareStore struct {
-	store [concurrentMapSize]*concurrentMap
+// shareStore 使用分段锁实现，即多个 map 分别拥有锁，以确保对 shareStore 尽可能高的并行访问
+// 以前固定 256 个分段，核数很多时还是会争用，现在默认为 GOMAXPROCS 的倍数
+type shareStore[V any] struct {
+	store []*concurrentMap[V]
 }
 
-func newShareStore() *shareStore {
-	s := &shareStore{}
+// newShareStore clk 用于判断是否过期，onExpire 在 Get 删除已过期的 item 后调用（已经解锁），为 nil 则不通知
+// shards 为分段的数量，小于等于 0 时使用 defaultShards
+func newShareStore[V any](clk clock.Clock, onExpire func(storeItem[V]), shards int) *shareStore[V] {
+	if shards <= 0 {
+		shards = defaultShards()
+	}
+	s := &shareStore[V]{
+		store: make([]*concurrentMap[V], shards),
+	}
 
-	for i := 0; i < concurrentMapSize; i++ {
-		s.store[i] = new(concurrentMap)
-		s.store[i].date = make(map[uint64]*storeItem)
+	for i := 0; i < shards; i++ {
+		s.store[i] = new(concurrentMap[V])
+		s.store[i].date = make(map[uint64]*storeItem[V])
+		s.store[i].clock = clk
+		s.store[i].onExpire = onExpire
 	}
 
 	return s
 }
 
-func (s *shareStore) Get(hashKey, conflict uint64) (interface{}, bool) {
-	return s.store[hashKey%concurrentMapSize].get(hashKey, conflict)
+func (s *shareStore[V]) shard(hashKey uint64) *concurrentMap[V] {
+	return s.store[hashKey%uint64(len(s.store))]
+}
+
+func (s *shareStore[V]) Get(hashKey, conflict uint64) (V, bool) {
+	return s.shard(hashKey).get(hashKey, conflict)
+}
+
+func (s *shareStore[V]) GetItem(hashKey, conflict uint64) (storeItem[V], bool) {
+	return s.shard(hashKey).getItem(hashKey, conflict)
+}
+
+func (s *shareStore[V]) Peek(hashKey, conflict uint64) (storeItem[V], bool) {
+	return s.shard(hashKey).peek(hashKey, conflict)
+}
+
+func (s *shareStore[V]) Add(item storeItem[V]) bool {
+	return s.shard(item.hashKey).add(item)
+}
+
+func (s *shareStore[V]) Update(item storeItem[V]) (storeItem[V], bool) {
+	return s.shard(item.hashKey).update(item)
+}
+
+func (s *shareStore[V]) Expiration(hashKey, conflict uint64) (time.Time, bool) {
+	return s.shard(hashKey).getExpiration(hashKey, conflict)
+}
+
+func (s *shareStore[V]) Touch(hashKey, conflict uint64, expiration time.Time, sliding time.Duration) (storeItem[V], bool) {
+	return s.shard(hashKey).touch(hashKey, conflict, expiration, sliding)
 }
 
-func (s *shareStore) Add(hashKey, conflict uint64, value interface{}, expiration time.Time) bool {
-	return s.store[hashKey%concurrentMapSize].add(hashKey, conflict, value, expiration)
+func (s *shareStore[V]) Del(hashKey, conflict uint64) (storeItem[V], bool) {
+	return s.shard(hashKey).del(hashKey, conflict)
 }
 
-func (s *shareStore) Del(hashKey, conflict uint64) (interface{}, bool) {
-	return s.store[hashKey%concurrentMapSize].del(hashKey, conflict)
+func (s *shareStore[V]) Shards() int {
+	return len(s.store)
 }
 
-type concurrentMap struct {
+func (s *shareStore[V]) Snapshot(shard int) []storeItem[V] {
+	return s.store[shard].snapshot()
+}
+
+func (s *shareStore[V]) Clear() {
+	for i := range s.store {
+		s.store[i].clear()
+	}
+}
+
+type concurrentMap[V any] struct {
 	// mutex 不采用匿名引入，因为 Lock 和 Unlock 方法不需要暴露出来
 	// 同时在方法内部调用 Lock，使得方法是并发安全的
-	mutex sync.Mutex
-	date  map[uint64]*storeItem
+	// 读多写少，所以用读写锁，只读的方法（get 大部分情况下也是只读的）只加读锁，多个读可以并行
+	mutex    sync.RWMutex
+	date     map[uint64]*storeItem[V]
+	clock    clock.Clock
+	onExpire func(storeItem[V])
 }
 
-func (m *concurrentMap) get(hashKey, conflict uint64) (interface{}, bool) {
-	m.mutex.Lock()
+func (m *concurrentMap[V]) get(hashKey, conflict uint64) (V, bool) {
+	item, ok := m.getItem(hashKey, conflict)
+	return item.value, ok
+}
+
+func (m *concurrentMap[V]) getItem(hashKey, conflict uint64) (storeItem[V], bool) {
+	m.mutex.RLock()
 
 	// 存在
-	if item, ok := m.date[hashKey]; ok && item.conflict == conflict {
-		// 且未超时
-		if item.expiration.IsZero() || item.expiration.After(time.Now()) {
-			m.mutex.Unlock()
-			return item.value, ok
+	item, ok := m.date[hashKey]
+	if !ok || item.conflict != conflict {
+		m.mutex.RUnlock()
+		return storeItem[V]{}, false
+	}
+
+	// 且未超时，不是滑动过期的不需要修改，读锁就够了
+	now := m.clock.Now()
+	alive := item.expiration.IsZero() || item.expiration.After(now)
+	if alive && item.sliding == 0 {
+		// update 会原地修改 item，所以要在锁内复制
+		res := *item
+		m.mutex.RUnlock()
+		return res, true
+	}
+	m.mutex.RUnlock()
+
+	// 需要延长过期时间或者删除，换成写锁，期间可能已经被修改了，所以要重新检查
+	m.mutex.Lock()
+	item, ok = m.date[hashKey]
+	if !ok || item.conflict != conflict {
+		m.mutex.Unlock()
+		return storeItem[V]{}, false
+	}
+	if item.expiration.IsZero() || item.expiration.After(now) {
+		if item.sliding > 0 {
+			item.expiration = now.Add(item.sliding)
 		}
+		res := *item
+		m.mutex.Unlock()
+		return res, true
 	}
 
+	// 已经过期了，不等定期清理，直接删除，否则会一直占用 cost 直到被清理
+	delete(m.date, hashKey)
 	m.mutex.Unlock()
-	return nil, false
+
+	if m.onExpire != nil {
+		m.onExpire(*item)
+	}
+	return storeItem[V]{}, false
+}
+
+func (m *concurrentMap[V]) peek(hashKey, conflict uint64) (storeItem[V], bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	item, ok := m.alive(hashKey, conflict)
+	if !ok {
+		return storeItem[V]{}, false
+	}
+	return *item, true
 }
 
-func (m *concurrentMap) add(hashKey, conflict uint64, value interface{}, expiration time.Time) bool {
+func (m *concurrentMap[V]) add(newItem storeItem[V]) bool {
 	m.mutex.Lock()
 
-	if !expiration.IsZero() && expiration.Before(time.Now()) {
+	now := m.clock.Now()
+	if !newItem.expiration.IsZero() && newItem.expiration.Before(now) {
 		m.mutex.Unlock()
 		return false
 	}
 
 	// hashKey 已存在，当然可能 conflict 不相等，但这种情况是不能存进去的，map 的 key 不允许重复，会覆盖原来的 key
 	// hashKey 已存在，但是过期了，直接覆盖存进去就可以了
-	if item, ok := m.date[hashKey]; ok {
-		if item.expiration.IsZero() || item.expiration.After(time.Now()) {
+	if item, ok := m.date[newItem.hashKey]; ok {
+		if item.expiration.IsZero() || item.expiration.After(now) {
 			m.mutex.Unlock()
 			return false
 		}
 	}
 
-	m.date[hashKey] = &storeItem{
-		hashKey:    hashKey,
-		conflict:   conflict,
-		value:      value,
-		expiration: expiration,
-	}
+	newItem.created = now
+	m.date[newItem.hashKey] = &newItem
 
 	m.mutex.Unlock()
 	return true
 }
 
-func (m *concurrentMap) del(hashKey, conflict uint64) (interface{}, bool) {
+func (m *concurrentMap[V]) update(newItem storeItem[V]) (storeItem[V], bool) {
+	m.mutex.Lock()
+
+	item, ok := m.alive(newItem.hashKey, newItem.conflict)
+	// 不存在、不是同一个 key 或者已经过期了，都当做不存在，由调用方重新加入
+	if !ok {
+		m.mutex.Unlock()
+		return storeItem[V]{}, false
+	}
+
+	old := *item
+	item.value = newItem.value
+	item.cost = newItem.cost
+	item.expiration = newItem.expiration
+	item.sliding = newItem.sliding
+
+	m.mutex.Unlock()
+	return old, true
+}
+
+func (m *concurrentMap[V]) getExpiration(hashKey, conflict uint64) (time.Time, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	item, ok := m.alive(hashKey, conflict)
+	if !ok {
+		return time.Time{}, false
+	}
+	return item.expiration, true
+}
+
+func (m *concurrentMap[V]) touch(hashKey, conflict uint64, expiration time.Time, sliding time.Duration) (storeItem[V], bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item, ok := m.alive(hashKey, conflict)
+	if !ok {
+		return storeItem[V]{}, false
+	}
+
+	old := *item
+	item.expiration = expiration
+	item.sliding = sliding
+	return old, true
+}
+
+// alive 存在、是同一个 key 且未过期，调用方需要上锁
+func (m *concurrentMap[V]) alive(hashKey, conflict uint64) (*storeItem[V], bool) {
+	item, ok := m.date[hashKey]
+	if !ok || item.conflict != conflict || (!item.expiration.IsZero() && !item.expiration.After(m.clock.Now())) {
+		return nil, false
+	}
+	return item, true
+}
+
+func (m *concurrentMap[V]) del(hashKey, conflict uint64) (storeItem[V], bool) {
 	m.mutex.Lock()
 
 	item, ok := m.date[hashKey]
 
-	// 不存在或者 conflict 不相等(conflict != 0 表示不用看 conflict)
+	// 不存在或者 conflict 不相等(conflict == 0 表示不用看 conflict)
 	// 因为 policy 只存 hashKey，不存 conflict，所以从 policy 淘汰只需要用到 key
-	if !ok || (item.conflict != 0 && item.conflict != conflict) {
+	if !ok || (conflict != 0 && item.conflict != conflict) {
 		m.mutex.Unlock()
-		return nil, false
+		return storeItem[V]{}, false
 	}
 
 	delete(m.date, hashKey)
 
 	m.mutex.Unlock()
-	return item.value, true
+	return *item, true
+}
+
+func (m *concurrentMap[V]) snapshot() []storeItem[V] {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	now := m.clock.Now()
+	items := make([]storeItem[V], 0, len(m.date))
+	for _, item := range m.date {
+		if item.expiration.IsZero() || item.expiration.After(now) {
+			items = append(items, *item)
+		}
+	}
+	return items
+}
+
+func (m *concurrentMap[V]) clear() {
+	m.mutex.Lock()
+	m.date = make(map[uint64]*storeItem[V])
+	m.mutex.Unlock()
 }
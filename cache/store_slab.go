@@ -0,0 +1,507 @@
+package cache
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
+)
+
+const (
+	// slabShards 分段的数量，比 shareStore 的少，因为每个分段的每种大小都至少要分配一个 slab，所以也不受 OptionShards 影响
+	slabShards = 32
+	// slabBits 每个 slab 64KB，位置的低 16 位是 slab 内的偏移，高 16 位是第几个 slab，所以每个分段最多 4GB
+	slabBits  = 16
+	slabBytes = 1 << slabBits
+	maxSlabs  = 1 << (32 - slabBits)
+	// slabMinChunk 最小的 chunk，放得下头部和一个很小的 value
+	slabMinChunk = 64
+	// slabHeaderSize 每个 chunk 的头部：hashKey、conflict、expiration、created、sliding、cost、value 的长度
+	slabHeaderSize = 8*6 + 4
+	// slabLarge 超过 slabBytes 的独占一个 slab，释放时整个 slab 交给 GC
+	slabLarge = -1
+)
+
+// slabChunkSizes 每种 chunk 的大小，按 1.25 倍增长（同 memcached 的 -f 参数），浪费的空间不超过 20%
+var slabChunkSizes = func() []int {
+	var sizes []int
+	for size := slabMinChunk; size < slabBytes; size = (size*5/4 + 7) &^ 7 {
+		sizes = append(sizes, size)
+	}
+	return append(sizes, slabBytes)
+}()
+
+// slabStore 存放字节 value 的 store，value 编码后复制到预先分配的 64KB 的 slab 中，索引为 map[uint64]uint32
+// concurrentMap 中每个 item 都是指针，value 为 interface{} 时也是指针，几百万个 key 时 GC 需要扫描几百万个指针
+// slabStore 中 map 的 key 和 value 都不是指针，GC 只需要扫描每个 slab 的指针
+// 同 memcached 的 slab 分配：每个 slab 只分配一种大小的 chunk，释放的 chunk 放回对应大小的空闲列表，下次加入时复用
+// 淘汰仍然由 policy 决定，所以 slab 不够时就分配新的，不会自己覆盖旧的（bigcache 和 freecache 是环形缓冲区，满了就覆盖）
+// 代价是 Get 需要解码（复制）value，开启 OptionKeepKeys 时 key 仍然是指针
+type slabStore[V any] struct {
+	shards [slabShards]*slabShard[V]
+}
+
+type slabShard[V any] struct {
+	mutex    sync.Mutex
+	codec    ValueCodec[V]
+	clock    clock.Clock
+	onExpire func(storeItem[V])
+	// hashKey -> chunk 的位置
+	index map[uint64]uint32
+	slabs [][]byte
+	// 每个 slab 的 chunk 大小是 slabChunkSizes 中的第几个，slabLarge 表示大 value 独占
+	slabClass []int8
+	// 大 value 释放后空出来的 slab 的下标
+	freeSlabs []uint32
+	classes   []slabClass
+	// 原始的 key，只有开启了 OptionKeepKeys 才保存
+	keys map[uint64]interface{}
+}
+
+// slabClass 一种大小的 chunk
+type slabClass struct {
+	// 释放的 chunk 的位置
+	free []uint32
+	// 最新的 slab 中下一个还没有分配过的 chunk，left 为剩余的数量
+	next uint32
+	left int
+}
+
+func newSlabStore[V any](clk clock.Clock, onExpire func(storeItem[V]), codec ValueCodec[V]) *slabStore[V] {
+	s := &slabStore[V]{}
+	for i := range s.shards {
+		s.shards[i] = &slabShard[V]{
+			codec:    codec,
+			clock:    clk,
+			onExpire: onExpire,
+		}
+		s.shards[i].reset()
+	}
+	return s
+}
+
+func (s *slabStore[V]) shard(hashKey uint64) *slabShard[V] {
+	return s.shards[hashKey%slabShards]
+}
+
+func (s *slabStore[V]) Get(hashKey, conflict uint64) (V, bool) {
+	return s.shard(hashKey).get(hashKey, conflict)
+}
+
+func (s *slabStore[V]) GetItem(hashKey, conflict uint64) (storeItem[V], bool) {
+	return s.shard(hashKey).getItem(hashKey, conflict)
+}
+
+func (s *slabStore[V]) Peek(hashKey, conflict uint64) (storeItem[V], bool) {
+	return s.shard(hashKey).peek(hashKey, conflict)
+}
+
+func (s *slabStore[V]) Add(item storeItem[V]) bool {
+	return s.shard(item.hashKey).add(item)
+}
+
+func (s *slabStore[V]) Update(item storeItem[V]) (storeItem[V], bool) {
+	return s.shard(item.hashKey).update(item)
+}
+
+func (s *slabStore[V]) Expiration(hashKey, conflict uint64) (time.Time, bool) {
+	return s.shard(hashKey).getExpiration(hashKey, conflict)
+}
+
+func (s *slabStore[V]) Touch(hashKey, conflict uint64, expiration time.Time, sliding time.Duration) (storeItem[V], bool) {
+	return s.shard(hashKey).touch(hashKey, conflict, expiration, sliding)
+}
+
+func (s *slabStore[V]) Del(hashKey, conflict uint64) (storeItem[V], bool) {
+	return s.shard(hashKey).del(hashKey, conflict)
+}
+
+func (s *slabStore[V]) Shards() int {
+	return len(s.shards)
+}
+
+func (s *slabStore[V]) Snapshot(shard int) []storeItem[V] {
+	return s.shards[shard].snapshot()
+}
+
+func (s *slabStore[V]) Clear() {
+	for i := range s.shards {
+		s.shards[i].mutex.Lock()
+		s.shards[i].reset()
+		s.shards[i].mutex.Unlock()
+	}
+}
+
+// slabHeader chunk 的头部，除了 value 之外 storeItem 的所有字段
+type slabHeader struct {
+	hashKey    uint64
+	conflict   uint64
+	expiration int64
+	created    int64
+	sliding    int64
+	cost       int64
+	length     uint32
+}
+
+func (h *slabHeader) encode(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:], h.hashKey)
+	binary.LittleEndian.PutUint64(b[8:], h.conflict)
+	binary.LittleEndian.PutUint64(b[16:], uint64(h.expiration))
+	binary.LittleEndian.PutUint64(b[24:], uint64(h.created))
+	binary.LittleEndian.PutUint64(b[32:], uint64(h.sliding))
+	binary.LittleEndian.PutUint64(b[40:], uint64(h.cost))
+	binary.LittleEndian.PutUint32(b[48:], h.length)
+}
+
+func (h *slabHeader) decode(b []byte) {
+	h.hashKey = binary.LittleEndian.Uint64(b[0:])
+	h.conflict = binary.LittleEndian.Uint64(b[8:])
+	h.expiration = int64(binary.LittleEndian.Uint64(b[16:]))
+	h.created = int64(binary.LittleEndian.Uint64(b[24:]))
+	h.sliding = int64(binary.LittleEndian.Uint64(b[32:]))
+	h.cost = int64(binary.LittleEndian.Uint64(b[40:]))
+	h.length = binary.LittleEndian.Uint32(b[48:])
+}
+
+// alive 同 concurrentMap.alive，返回位置和头部，调用方需要上锁
+func (m *slabShard[V]) alive(hashKey, conflict uint64) (uint32, slabHeader, bool) {
+	var h slabHeader
+	loc, ok := m.index[hashKey]
+	if !ok {
+		return 0, h, false
+	}
+	h.decode(m.chunk(loc))
+	if h.conflict != conflict || (h.expiration != 0 && h.expiration <= m.clock.Now().UnixNano()) {
+		return 0, h, false
+	}
+	return loc, h, true
+}
+
+func (m *slabShard[V]) get(hashKey, conflict uint64) (V, bool) {
+	item, ok := m.getItem(hashKey, conflict)
+	return item.value, ok
+}
+
+func (m *slabShard[V]) getItem(hashKey, conflict uint64) (storeItem[V], bool) {
+	m.mutex.Lock()
+
+	loc, ok := m.index[hashKey]
+	if !ok {
+		m.mutex.Unlock()
+		return storeItem[V]{}, false
+	}
+	b := m.chunk(loc)
+	var h slabHeader
+	h.decode(b)
+	if h.conflict != conflict {
+		m.mutex.Unlock()
+		return storeItem[V]{}, false
+	}
+
+	if now := m.clock.Now().UnixNano(); h.expiration == 0 || h.expiration > now {
+		if h.sliding > 0 {
+			h.expiration = now + h.sliding
+			h.encode(b)
+		}
+		value, err := m.value(b, h)
+		if err != nil {
+			m.mutex.Unlock()
+			return storeItem[V]{}, false
+		}
+		item := m.header(h)
+		item.value = value
+		m.mutex.Unlock()
+		return item, true
+	}
+
+	// 已经过期了，同 concurrentMap.get
+	old := m.item(loc, h)
+	m.remove(hashKey, loc)
+	m.mutex.Unlock()
+
+	if m.onExpire != nil {
+		m.onExpire(old)
+	}
+	return storeItem[V]{}, false
+}
+
+func (m *slabShard[V]) peek(hashKey, conflict uint64) (storeItem[V], bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	loc, h, ok := m.alive(hashKey, conflict)
+	if !ok {
+		return storeItem[V]{}, false
+	}
+	return m.item(loc, h), true
+}
+
+func (m *slabShard[V]) add(newItem storeItem[V]) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now()
+	if !newItem.expiration.IsZero() && newItem.expiration.Before(now) {
+		return false
+	}
+
+	// 已存在且未过期则不加入，过期了直接覆盖
+	if loc, ok := m.index[newItem.hashKey]; ok {
+		var h slabHeader
+		h.decode(m.chunk(loc))
+		if h.expiration == 0 || h.expiration > now.UnixNano() {
+			return false
+		}
+		m.remove(newItem.hashKey, loc)
+	}
+
+	newItem.created = now
+	return m.put(newItem)
+}
+
+func (m *slabShard[V]) update(newItem storeItem[V]) (storeItem[V], bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	loc, h, ok := m.alive(newItem.hashKey, newItem.conflict)
+	if !ok {
+		return storeItem[V]{}, false
+	}
+
+	old := m.item(loc, h)
+	m.remove(newItem.hashKey, loc)
+	newItem.created = old.created
+	newItem.key = old.key
+	// value 编码失败或者分配不了，旧的已经删除了，当成不存在，由调用方重新加入
+	if !m.put(newItem) {
+		return storeItem[V]{}, false
+	}
+	return old, true
+}
+
+func (m *slabShard[V]) getExpiration(hashKey, conflict uint64) (time.Time, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, h, ok := m.alive(hashKey, conflict)
+	if !ok {
+		return time.Time{}, false
+	}
+	return unixNanoTime(h.expiration), true
+}
+
+func (m *slabShard[V]) touch(hashKey, conflict uint64, expiration time.Time, sliding time.Duration) (storeItem[V], bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	loc, h, ok := m.alive(hashKey, conflict)
+	if !ok {
+		return storeItem[V]{}, false
+	}
+
+	old := m.item(loc, h)
+	h.expiration = timeUnixNano(expiration)
+	h.sliding = int64(sliding)
+	h.encode(m.chunk(loc))
+	return old, true
+}
+
+func (m *slabShard[V]) del(hashKey, conflict uint64) (storeItem[V], bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	loc, ok := m.index[hashKey]
+	if !ok {
+		return storeItem[V]{}, false
+	}
+	var h slabHeader
+	h.decode(m.chunk(loc))
+	// conflict == 0 表示不用看 conflict，同 concurrentMap.del
+	if conflict != 0 && h.conflict != conflict {
+		return storeItem[V]{}, false
+	}
+
+	old := m.item(loc, h)
+	m.remove(hashKey, loc)
+	return old, true
+}
+
+func (m *slabShard[V]) snapshot() []storeItem[V] {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now().UnixNano()
+	items := make([]storeItem[V], 0, len(m.index))
+	for _, loc := range m.index {
+		var h slabHeader
+		h.decode(m.chunk(loc))
+		if h.expiration == 0 || h.expiration > now {
+			items = append(items, m.item(loc, h))
+		}
+	}
+	return items
+}
+
+// reset 调用方需要上锁
+func (m *slabShard[V]) reset() {
+	m.index = make(map[uint64]uint32)
+	m.slabs = nil
+	m.slabClass = nil
+	m.freeSlabs = nil
+	m.classes = make([]slabClass, len(slabChunkSizes))
+	m.keys = make(map[uint64]interface{})
+}
+
+// put 编码后写入新分配的 chunk，调用方需要上锁，并保证 hashKey 不存在
+func (m *slabShard[V]) put(item storeItem[V]) bool {
+	value, err := m.codec.Encode(item.value)
+	if err != nil {
+		return false
+	}
+	loc, b, ok := m.alloc(slabHeaderSize + len(value))
+	if !ok {
+		return false
+	}
+
+	h := slabHeader{
+		hashKey:    item.hashKey,
+		conflict:   item.conflict,
+		expiration: timeUnixNano(item.expiration),
+		created:    timeUnixNano(item.created),
+		sliding:    int64(item.sliding),
+		cost:       item.cost,
+		length:     uint32(len(value)),
+	}
+	h.encode(b)
+	copy(b[slabHeaderSize:], value)
+
+	m.index[item.hashKey] = loc
+	if item.key != nil {
+		m.keys[item.hashKey] = item.key
+	}
+	return true
+}
+
+// remove 删除并释放 chunk，调用方需要上锁
+func (m *slabShard[V]) remove(hashKey uint64, loc uint32) {
+	delete(m.index, hashKey)
+	delete(m.keys, hashKey)
+	m.free(loc)
+}
+
+// item 解码出完整的 storeItem，value 解码失败时为零值，调用方需要上锁
+func (m *slabShard[V]) item(loc uint32, h slabHeader) storeItem[V] {
+	item := m.header(h)
+	item.value, _ = m.value(m.chunk(loc), h)
+	return item
+}
+
+// header 除了 value 之外的字段，调用方需要上锁
+func (m *slabShard[V]) header(h slabHeader) storeItem[V] {
+	return storeItem[V]{
+		hashKey:    h.hashKey,
+		conflict:   h.conflict,
+		key:        m.keys[h.hashKey],
+		cost:       h.cost,
+		created:    unixNanoTime(h.created),
+		expiration: unixNanoTime(h.expiration),
+		sliding:    time.Duration(h.sliding),
+	}
+}
+
+// value slab 会被复用，所以复制一份再解码
+func (m *slabShard[V]) value(b []byte, h slabHeader) (V, error) {
+	value := make([]byte, h.length)
+	copy(value, b[slabHeaderSize:])
+	return m.codec.Decode(value)
+}
+
+// alloc 分配一个能放下 size 个字节的 chunk，返回位置和 chunk，调用方需要上锁
+func (m *slabShard[V]) alloc(size int) (uint32, []byte, bool) {
+	if size > slabBytes {
+		idx, ok := m.newSlab(make([]byte, size), slabLarge)
+		if !ok {
+			return 0, nil, false
+		}
+		return idx << slabBits, m.slabs[idx], true
+	}
+
+	class := sort.SearchInts(slabChunkSizes, size)
+	c := &m.classes[class]
+	if n := len(c.free); n > 0 {
+		loc := c.free[n-1]
+		c.free = c.free[:n-1]
+		return loc, m.chunk(loc), true
+	}
+
+	if c.left == 0 {
+		idx, ok := m.newSlab(make([]byte, slabBytes), int8(class))
+		if !ok {
+			return 0, nil, false
+		}
+		c.next = idx << slabBits
+		c.left = slabBytes / slabChunkSizes[class]
+	}
+	loc := c.next
+	c.next += uint32(slabChunkSizes[class])
+	c.left--
+	return loc, m.chunk(loc), true
+}
+
+// newSlab 优先复用大 value 释放后空出来的下标，调用方需要上锁
+func (m *slabShard[V]) newSlab(slab []byte, class int8) (uint32, bool) {
+	if n := len(m.freeSlabs); n > 0 {
+		idx := m.freeSlabs[n-1]
+		m.freeSlabs = m.freeSlabs[:n-1]
+		m.slabs[idx] = slab
+		m.slabClass[idx] = class
+		return idx, true
+	}
+	if len(m.slabs) >= maxSlabs {
+		return 0, false
+	}
+	m.slabs = append(m.slabs, slab)
+	m.slabClass = append(m.slabClass, class)
+	return uint32(len(m.slabs) - 1), true
+}
+
+// free 释放 chunk，调用方需要上锁
+func (m *slabShard[V]) free(loc uint32) {
+	idx := loc >> slabBits
+	class := m.slabClass[idx]
+	if class == slabLarge {
+		m.slabs[idx] = nil
+		m.freeSlabs = append(m.freeSlabs, idx)
+		return
+	}
+	m.classes[class].free = append(m.classes[class].free, loc)
+}
+
+// chunk 返回 loc 处的 chunk，调用方需要上锁
+func (m *slabShard[V]) chunk(loc uint32) []byte {
+	idx := loc >> slabBits
+	slab := m.slabs[idx]
+	class := m.slabClass[idx]
+	if class == slabLarge {
+		return slab
+	}
+	off := int(loc & (slabBytes - 1))
+	return slab[off : off+slabChunkSizes[class]]
+}
+
+// timeUnixNano 零值表示没有，编码为 0
+func timeUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
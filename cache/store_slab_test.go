@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
+)
+
+var bytesCodec = ValueCodec[[]byte]{
+	Encode: func(value []byte) ([]byte, error) {
+		return value, nil
+	},
+	Decode: func(b []byte) ([]byte, error) {
+		return b, nil
+	},
+}
+
+func TestSlabStore(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s := newSlabStore[[]byte](clk, nil, bytesCodec)
+	hashKey, conflict := KeyToHash("ayang")
+
+	if ok := s.Add(storeItem[[]byte]{hashKey: hashKey, conflict: conflict, key: "ayang", value: []byte("ayangcache"), cost: 3}); !ok {
+		t.Fatalf("Add failed")
+	}
+	if ok := s.Add(storeItem[[]byte]{hashKey: hashKey, conflict: conflict, value: []byte("ayangcache")}); ok {
+		t.Fatalf("Add should fail when exist")
+	}
+	if v, ok := s.Get(hashKey, conflict); !ok || string(v) != "ayangcache" {
+		t.Fatalf("Get failed")
+	}
+	if _, ok := s.Get(hashKey, conflict+1); ok {
+		t.Fatalf("Get with wrong conflict should fail")
+	}
+	if item, ok := s.GetItem(hashKey, conflict); !ok || string(item.value) != "ayangcache" || item.cost != 3 || item.key != "ayang" {
+		t.Fatalf("GetItem = %+v", item)
+	}
+	item, ok := s.Peek(hashKey, conflict)
+	if !ok || item.key != "ayang" || item.cost != 3 || !item.created.Equal(clk.Now()) {
+		t.Fatalf("Peek = %+v", item)
+	}
+
+	// 更新为更大的 value，换到更大的 chunk，created 不变
+	clk.Add(time.Second)
+	big := bytes.Repeat([]byte("a"), 1000)
+	if old, ok := s.Update(storeItem[[]byte]{hashKey: hashKey, conflict: conflict, value: big, expiration: clk.Now().Add(time.Minute), sliding: time.Minute}); !ok || string(old.value) != "ayangcache" {
+		t.Fatalf("Update failed")
+	}
+	if item, _ = s.Peek(hashKey, conflict); !bytes.Equal(item.value, big) || !item.created.Equal(clk.Now().Add(-time.Second)) || item.key != "ayang" {
+		t.Fatalf("Peek after Update = %+v", item)
+	}
+
+	// 滑动过期
+	clk.Add(30 * time.Second)
+	s.Get(hashKey, conflict)
+	if e, ok := s.Expiration(hashKey, conflict); !ok || !e.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("Get should extend sliding expiration, got %v", e)
+	}
+	if _, ok := s.Touch(hashKey, conflict, clk.Now().Add(time.Second), 0); !ok {
+		t.Fatalf("Touch failed")
+	}
+	clk.Add(time.Second)
+	if _, ok := s.Get(hashKey, conflict); ok {
+		t.Fatalf("Get after expiration should fail")
+	}
+	if _, ok := s.Del(hashKey, 0); ok {
+		t.Fatalf("expired item should be deleted by Get")
+	}
+}
+
+// TestSlabStore_Reuse 释放的 chunk 和大 value 的 slab 都会被复用
+func TestSlabStore_Reuse(t *testing.T) {
+	s := newSlabStore[[]byte](clock.Real, nil, bytesCodec)
+	shard := s.shards[0]
+	value := bytes.Repeat([]byte("v"), 100)
+	large := bytes.Repeat([]byte("l"), slabBytes)
+
+	// hashKey 都是 slabShards 的倍数，在同一个分段
+	for round := 0; round < 3; round++ {
+		for i := uint64(1); i <= 1000; i++ {
+			if !s.Add(storeItem[[]byte]{hashKey: i * slabShards, conflict: i, value: value}) {
+				t.Fatalf("Add %d failed", i)
+			}
+		}
+		if !s.Add(storeItem[[]byte]{hashKey: 1001 * slabShards, conflict: 1, value: large}) {
+			t.Fatalf("Add large failed")
+		}
+		for i := uint64(1); i <= 1000; i++ {
+			if v, ok := s.Get(i*slabShards, i); !ok || !bytes.Equal(v, value) {
+				t.Fatalf("Get %d failed", i)
+			}
+			s.Del(i*slabShards, i)
+		}
+		if v, ok := s.Get(1001*slabShards, 1); !ok || !bytes.Equal(v, large) {
+			t.Fatalf("Get large failed")
+		}
+		s.Del(1001*slabShards, 1)
+	}
+
+	// 头部加 value 152 字节，放在 176 字节的 chunk 中，1000 个需要 3 个 slab，加上 1 个大 value 独占的
+	if len(shard.slabs) != 4 {
+		t.Fatalf("%d slabs, want 4", len(shard.slabs))
+	}
+	if len(shard.index) != 0 {
+		t.Fatalf("index has %d keys after Del", len(shard.index))
+	}
+
+	s.Clear()
+	if len(shard.slabs) != 0 {
+		t.Fatalf("%d slabs after Clear", len(shard.slabs))
+	}
+}
+
+func TestCache_SlabStore(t *testing.T) {
+	c := New[string, []byte](1000, 100, OptionSlabStore(bytesCodec), OptionKeepKeys())
+	defer c.Close()
+
+	c.Set("ayang", []byte("ayangcache"), 1)
+	c.SetWithTTL("tom", []byte("tomcache"), 1, time.Minute)
+	c.Wait()
+	if v, ok := c.Get("ayang"); !ok || string(v) != "ayangcache" {
+		t.Fatalf("Get failed")
+	}
+	if ttl, ok := c.GetTTL("tom"); !ok || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("GetTTL = %v, %v", ttl, ok)
+	}
+
+	n := 0
+	c.Range(func(key string, value []byte, cost int64, expiration time.Time) bool {
+		if key != "ayang" && key != "tom" {
+			t.Fatalf("Range key %s", key)
+		}
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Fatalf("Range %d keys, want 2", n)
+	}
+
+	c.Del("ayang")
+	if _, ok := c.Get("ayang"); ok {
+		t.Fatalf("Get after Del should fail")
+	}
+}
@@ -1,19 +1,24 @@
 package cache
 
 import (
+	"fmt"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
 )
 
 func TestShareStore_Add_Get_Del(t *testing.T) {
-	s := newShareStore()
+	s := newShareStore[interface{}](clock.Real, nil, 0)
 	hashKey, conflict := KeyToHash("ayang")
 
-	if ok := s.Add(hashKey, conflict, "ayangcache", time.Time{}); !ok {
+	if ok := s.Add(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "ayangcache"}); !ok {
 		t.Fatalf("Add failed")
 	}
 
-	if ok := s.Add(hashKey, conflict, "ayangcache", time.Time{}); ok {
+	if ok := s.Add(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "ayangcache"}); ok {
 		t.Fatalf("Add failed")
 	}
 
@@ -21,7 +26,7 @@ func TestShareStore_Add_Get_Del(t *testing.T) {
 		t.Fatalf("Get failed")
 	}
 
-	if v, ok := s.Del(hashKey, conflict); !ok || "ayangcache" != v.(string) {
+	if v, ok := s.Del(hashKey, conflict); !ok || "ayangcache" != v.value.(string) {
 		t.Fatalf("Del failed")
 	}
 
@@ -35,10 +40,11 @@ func TestShareStore_Add_Get_Del(t *testing.T) {
 }
 
 func TestExpiration(t *testing.T) {
-	s := newShareStore()
+	clk := clock.NewFake(time.Time{})
+	s := newShareStore[interface{}](clk, nil, 0)
 	hashKey, conflict := KeyToHash("ayang")
 
-	if ok := s.Add(hashKey, conflict, "ayangcache", time.Now().Add(time.Second)); !ok {
+	if ok := s.Add(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "ayangcache", expiration: clk.Now().Add(time.Second)}); !ok {
 		t.Fatalf("Add expiration failed")
 	}
 
@@ -46,9 +52,198 @@ func TestExpiration(t *testing.T) {
 		t.Fatalf("Get expiration failed")
 	}
 
-	time.Sleep(time.Second)
+	clk.Add(time.Second)
 	if _, ok := s.Get(hashKey, conflict); ok {
 		t.Fatalf("Get expitation falied")
 	}
 
 }
+
+func TestShareStore_Update_Clear(t *testing.T) {
+	s := newShareStore[interface{}](clock.Real, nil, 0)
+	hashKey, conflict := KeyToHash("ayang")
+
+	if _, ok := s.Update(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "ayangcache"}); ok {
+		t.Fatalf("Update should fail when not exist")
+	}
+
+	s.Add(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "ayangcache"})
+	expiration := time.Now().Add(time.Minute)
+	if old, ok := s.Update(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "ayangcache2", expiration: expiration}); !ok || old.value.(string) != "ayangcache" {
+		t.Fatalf("Update failed")
+	}
+	if v, ok := s.Get(hashKey, conflict); !ok || v.(string) != "ayangcache2" {
+		t.Fatalf("Get after Update failed")
+	}
+
+	// 淘汰时 conflict 为 0，不看 conflict
+	if old, ok := s.Del(hashKey, 0); !ok || !old.expiration.Equal(expiration) {
+		t.Fatalf("Del with 0 conflict failed")
+	}
+
+	s.Add(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "ayangcache"})
+	s.Clear()
+	if _, ok := s.Get(hashKey, conflict); ok {
+		t.Fatalf("Clear failed")
+	}
+}
+
+func TestShareStore_Sliding_Touch(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s := newShareStore[interface{}](clk, nil, 0)
+	hashKey, conflict := KeyToHash("ayang")
+
+	s.Add(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "ayangcache", expiration: clk.Now().Add(time.Millisecond), sliding: time.Minute})
+	// Get 命中后延长到 now + 1 分钟
+	s.Get(hashKey, conflict)
+	if e, ok := s.Expiration(hashKey, conflict); !ok || !e.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("Get should extend sliding expiration, got %v", e)
+	}
+
+	if old, ok := s.Touch(hashKey, conflict, time.Time{}, 0); !ok || old.sliding != time.Minute {
+		t.Fatalf("Touch failed")
+	}
+	if e, ok := s.Expiration(hashKey, conflict); !ok || !e.IsZero() {
+		t.Fatalf("Touch should remove expiration, got %v", e)
+	}
+}
+
+func TestShareStore_Snapshot(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s := newShareStore[interface{}](clk, nil, 0)
+
+	for i := 0; i < 1000; i++ {
+		hashKey, conflict := KeyToHash(i)
+		s.Add(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, key: i, value: i, cost: 1})
+	}
+	hashKey, conflict := KeyToHash("expired")
+	s.Add(storeItem[interface{}]{hashKey: hashKey, conflict: conflict, value: "expired", expiration: clk.Now().Add(time.Second)})
+	clk.Add(time.Second)
+
+	seen := make(map[int]bool)
+	for shard := 0; shard < s.Shards(); shard++ {
+		for _, item := range s.Snapshot(shard) {
+			if item.key.(int) != item.value.(int) {
+				t.Fatalf("key %v value %v", item.key, item.value)
+			}
+			seen[item.key.(int)] = true
+		}
+	}
+	if len(seen) != 1000 {
+		t.Fatalf("snapshot has %d keys, want 1000", len(seen))
+	}
+}
+
+// TestShareStore_ConcurrentUpdateGet 同一个 key 并发 Update 和 Get，用 -race 检查 Get 是否在锁外读取 value
+func TestShareStore_ConcurrentUpdateGet(t *testing.T) {
+	for _, sliding := range []time.Duration{0, time.Minute} {
+		s := newShareStore[string](clock.Real, nil, 0)
+		hashKey, conflict := KeyToHash("ayang")
+		newItem := func(value string) storeItem[string] {
+			item := storeItem[string]{hashKey: hashKey, conflict: conflict, value: value, sliding: sliding}
+			if sliding > 0 {
+				item.expiration = time.Now().Add(sliding)
+			}
+			return item
+		}
+		s.Add(newItem("0"))
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100000; i++ {
+				s.Update(newItem(strconv.Itoa(i)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100000; i++ {
+				if v, ok := s.Get(hashKey, conflict); !ok || v == "" {
+					t.Errorf("Get = %q, %v", v, ok)
+					return
+				}
+			}
+		}()
+		wg.Wait()
+	}
+}
+
+// benchmarkStoreKeys 预先加入的 key 的数量
+const benchmarkStoreKeys = 1 << 16
+
+func newBenchmarkStore(shards int, sliding time.Duration) *shareStore[int] {
+	s := newShareStore[int](clock.Real, nil, shards)
+	expiration := time.Time{}
+	if sliding > 0 {
+		expiration = time.Now().Add(sliding)
+	}
+	for i := 0; i < benchmarkStoreKeys; i++ {
+		hashKey, conflict := KeyToHash(fmt.Sprint(i))
+		s.Add(storeItem[int]{hashKey: hashKey, conflict: conflict, value: i, expiration: expiration, sliding: sliding})
+	}
+	return s
+}
+
+// benchmarkShards 对比的分段数量，再加上默认值（已经有了就不重复）
+func benchmarkShards(shards ...int) []int {
+	for _, n := range shards {
+		if n == defaultShards() {
+			return shards
+		}
+	}
+	return append(shards, defaultShards())
+}
+
+func benchmarkKeys() [][2]uint64 {
+	keys := make([][2]uint64, benchmarkStoreKeys)
+	for i := range keys {
+		keys[i][0], keys[i][1] = KeyToHash(fmt.Sprint(i))
+	}
+	return keys
+}
+
+// BenchmarkShareStore_Get 不同分段数量下并发 Get 的扩展性，用 -cpu 1,8,64 对比
+// 不是滑动过期的 Get 只加读锁，滑动过期的 Get 需要写锁
+func BenchmarkShareStore_Get(b *testing.B) {
+	keys := benchmarkKeys()
+	for _, sliding := range []time.Duration{0, time.Hour} {
+		for _, shards := range benchmarkShards(1, 16, 256) {
+			b.Run(fmt.Sprintf("sliding=%t/shards=%d", sliding > 0, shards), func(b *testing.B) {
+				s := newBenchmarkStore(shards, sliding)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						key := keys[i&(benchmarkStoreKeys-1)]
+						s.Get(key[0], key[1])
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkShareStore_GetUpdate 读多写少，每 10 次有 1 次 Update
+func BenchmarkShareStore_GetUpdate(b *testing.B) {
+	keys := benchmarkKeys()
+	for _, shards := range benchmarkShards(1, 16, 256) {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newBenchmarkStore(shards, 0)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i&(benchmarkStoreKeys-1)]
+					if i%10 == 0 {
+						s.Update(storeItem[int]{hashKey: key[0], conflict: key[1], value: i})
+					} else {
+						s.Get(key[0], key[1])
+					}
+					i++
+				}
+			})
+		})
+	}
+}
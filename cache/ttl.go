@@ -3,95 +3,223 @@ package cache
 import (
 	"sync"
 	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
 )
 
 const (
-	// secondsPerBucket 该大小为时间周期，同一过期时间周期处于同一个 bucket
-	secondsPerBucket = int64(5)
-	// 过期周期的一半就检查，保证不会因延误而漏删
-	ticker = secondsPerBucket / 2
+	// defaultTTLTick 时间轮每一格的时间，也是定期清理的周期，见 OptionTTLTick
+	defaultTTLTick = time.Second
+	// 每层 64 格，共 4 层，能表示 64^4 个 tick（tick 为 1 秒时约 194 天），更远的放在最高层，到时候再重新计算
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 4
 )
 
-func expirationBucket(time time.Time) int64 {
-	return time.Unix()/secondsPerBucket + 1
-}
-
-func cleanBucket() int64 {
-	// 清除 1 个 secondsPerBucket 之前过期的 key
-	return time.Now().Unix()/secondsPerBucket - 1
-}
-
 type expiration interface {
 	Add(uint64, uint64, time.Time)
-	// Clean 通过函数传参依赖于 store 和 policy（设计模式中的依赖关系），还有另外 2 种解决方法
+	// Update 过期时间改变了，从旧的位置移动到新的位置
+	Update(hashKey, conflict uint64, oldExpiration, newExpiration time.Time)
+	// Del 删除过期时间
+	Del(hashKey uint64, expiration time.Time)
+	// Clear 删除全部
+	Clear()
+	// Clean 以前通过函数传参依赖于 store 和 policy（设计模式中的依赖关系），还有另外 2 种解决方法
 	// 2. store 和 policy 通过 newExpirationMap 时传入并作为内置的属性（设计模式中的关联关系，属于强依赖），后面通过 field.Method 调用
 	// 3. Clean() 既不需要属性依赖也不需要参数依赖，直接返回需要删除的 key，由外部 cache 调用 Clean 时接收然后再调用 store.Del 和 policy.Del
-	// 很明显我认为第 3 种是最好的，无依赖，且单一责职。先记录下，后面再来修改把。
-	Clean(store, policy)
+	// 很明显我认为第 3 种是最好的，无依赖，且单一责职。store 改为泛型后 expiration 也就不用跟着泛型了，所以改成了第 3 种
+	// 返回已过期的 key，map(hashKey, conflict)
+	Clean() bucket
 }
 
-// bucket 桶，处于同一个桶的是同一个 secondsPerBucket 秒过期周期的 key
-// 之所以用 slice 而不用 map，因为不允许更新，也就不需要快速查找替换功能，所有选用 slice 比 map 节省空间
-type bucket []itemPair
+// bucket map(hashKey, conflict)
+type bucket map[uint64]uint64
 
-type expirationMap struct {
+type wheelItem struct {
+	conflict uint64
+	// 过期时间对应的 tick（向上取整）
+	expTick int64
+}
+
+// slotRef key 所在的格子，level 为 -1 表示在 overdue 中
+type slotRef struct {
+	level int
+	slot  int
+}
+
+// timingWheel 分层时间轮（同 Linux 内核的定时器、Kafka 的 TimingWheel）
+// 以前按 5 秒分桶，每次只清理 1 个周期前的那个桶，如果定时器延误了，错过的桶就永远不会被清理了，而且也不支持小于 1 秒的过期时间
+// 时间轮的每一格为一个 tick，第 0 层每格 1 个 tick，第 1 层每格 64 个 tick，以此类推
+// key 根据距离过期还有多少个 tick 放到对应的层，高层的格子到期时再把里面的 key 重新放到低层（cascade）
+// Clean 会把上次清理之后到现在的每一个 tick 都走一遍，所以即使定时器延误了也不会漏掉
+type timingWheel struct {
 	// mutex 不采用匿名引入，因为 Lock 和 Unlock 方法不需要暴露出来
 	// 同时在方法内部调用 Lock，使得方法是并发安全的
-	mutex   sync.Mutex
-	buckets map[int64]*bucket
+	mutex sync.Mutex
+	clock clock.Clock
+	tick  time.Duration
+	// 已经处理到的 tick
+	cur   int64
+	slots [wheelLevels][wheelSlots]map[uint64]wheelItem
+	// 加入时就已经过期了，下次 Clean 直接返回
+	overdue map[uint64]wheelItem
+	// key 在哪个格子，删除时使用
+	where map[uint64]slotRef
 }
 
-type itemPair struct {
-	hashKey  uint64
-	conflict uint64
+func newTimingWheel(clk clock.Clock, tick time.Duration) *timingWheel {
+	if tick <= 0 {
+		tick = defaultTTLTick
+	}
+	tw := &timingWheel{
+		clock: clk,
+		tick:  tick,
+	}
+	tw.init()
+	return tw
 }
 
-func newExpirationMap() *expirationMap {
-	return &expirationMap{
-		buckets: make(map[int64]*bucket),
-	}
+// init 调用方需要上锁
+func (tw *timingWheel) init() {
+	tw.cur = tw.clock.Now().UnixNano() / int64(tw.tick)
+	tw.slots = [wheelLevels][wheelSlots]map[uint64]wheelItem{}
+	tw.overdue = make(map[uint64]wheelItem)
+	tw.where = make(map[uint64]slotRef)
 }
 
-func (em *expirationMap) Add(hashKey, conflict uint64, expiration time.Time) {
+// toTick 向上取整，保证到了这个 tick 时一定已经过期了
+func (tw *timingWheel) toTick(expiration time.Time) int64 {
+	ns := expiration.UnixNano()
+	return (ns + int64(tw.tick) - 1) / int64(tw.tick)
+}
+
+func (tw *timingWheel) Add(hashKey, conflict uint64, expiration time.Time) {
 	if expiration.IsZero() {
 		return
 	}
 
-	// 以过期时间所在的时间周期为 map 的 key 值
-	mapKey := expirationBucket(expiration)
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
 
-	em.mutex.Lock()
-	defer em.mutex.Unlock()
+	tw.add(hashKey, wheelItem{conflict: conflict, expTick: tw.toTick(expiration)})
+}
 
-	s, ok := em.buckets[mapKey]
+// add 调用方需要上锁
+func (tw *timingWheel) add(hashKey uint64, item wheelItem) {
+	tw.del(hashKey)
+
+	delta := item.expTick - tw.cur
+	if delta <= 0 {
+		tw.overdue[hashKey] = item
+		tw.where[hashKey] = slotRef{level: -1}
+		return
+	}
+
+	// 找到能放下的最低层，超出最高层的范围也先放在最高层
+	level := 0
+	for level < wheelLevels-1 && delta >= int64(1)<<(wheelBits*(level+1)) {
+		level++
+	}
+	slot := int(item.expTick>>(wheelBits*level)) & wheelMask
+
+	m := tw.slots[level][slot]
+	if m == nil {
+		m = make(map[uint64]wheelItem)
+		tw.slots[level][slot] = m
+	}
+	m[hashKey] = item
+	tw.where[hashKey] = slotRef{level: level, slot: slot}
+}
+
+// del 调用方需要上锁
+func (tw *timingWheel) del(hashKey uint64) {
+	ref, ok := tw.where[hashKey]
 	if !ok {
-		// 不存在该 bucket，说明是该 secondsPerBucket 周期内的第一个 key
-		s = new(bucket)
-		em.buckets[mapKey] = s
+		return
 	}
+	delete(tw.where, hashKey)
 
-	*s = append(*s, itemPair{hashKey: hashKey, conflict: conflict})
+	if ref.level < 0 {
+		delete(tw.overdue, hashKey)
+		return
+	}
+	delete(tw.slots[ref.level][ref.slot], hashKey)
 }
 
-func (em *expirationMap) Clean(store store, policy policy) {
-	// 获取需要删除的周期 key
-	mapKey := cleanBucket()
+func (tw *timingWheel) Update(hashKey, conflict uint64, _, newExpiration time.Time) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
 
-	em.mutex.Lock()
+	if newExpiration.IsZero() {
+		tw.del(hashKey)
+		return
+	}
+	tw.add(hashKey, wheelItem{conflict: conflict, expTick: tw.toTick(newExpiration)})
+}
 
-	s, ok := em.buckets[mapKey]
-	if !ok {
-		em.mutex.Unlock()
+func (tw *timingWheel) Del(hashKey uint64, expiration time.Time) {
+	if expiration.IsZero() {
 		return
 	}
 
-	// 删除时间周期桶
-	delete(em.buckets, mapKey)
-	em.mutex.Unlock()
+	tw.mutex.Lock()
+	tw.del(hashKey)
+	tw.mutex.Unlock()
+}
+
+func (tw *timingWheel) Clear() {
+	tw.mutex.Lock()
+	tw.init()
+	tw.mutex.Unlock()
+}
+
+func (tw *timingWheel) Clean() bucket {
+	now := tw.clock.Now().UnixNano() / int64(tw.tick)
 
-	// 根据桶中的 key 去 store 和 policy 中删除
-	for i := 0; i < len(*s); i++ {
-		store.Del((*s)[i].hashKey, (*s)[i].conflict)
-		policy.Del((*s)[i].hashKey)
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	expired := make(bucket)
+	for hashKey, item := range tw.overdue {
+		expired[hashKey] = item.conflict
+		delete(tw.where, hashKey)
+	}
+	tw.overdue = make(map[uint64]wheelItem)
+
+	// 把错过的 tick 都走一遍
+	for tw.cur < now {
+		tw.cur++
+
+		// 低层转了一圈，高层的格子到期了，从高到低把里面的 key 重新放到低层
+		level := 0
+		for level < wheelLevels-1 && tw.cur&(int64(1)<<(wheelBits*(level+1))-1) == 0 {
+			level++
+		}
+		for ; level > 0; level-- {
+			slot := int(tw.cur>>(wheelBits*level)) & wheelMask
+			m := tw.slots[level][slot]
+			tw.slots[level][slot] = nil
+			for hashKey, item := range m {
+				delete(tw.where, hashKey)
+				tw.add(hashKey, item)
+			}
+		}
+
+		slot := int(tw.cur) & wheelMask
+		for hashKey, item := range tw.slots[0][slot] {
+			expired[hashKey] = item.conflict
+			delete(tw.where, hashKey)
+		}
+		tw.slots[0][slot] = nil
 	}
+
+	// cascade 时到期的会放到 overdue
+	for hashKey, item := range tw.overdue {
+		expired[hashKey] = item.conflict
+		delete(tw.where, hashKey)
+	}
+	tw.overdue = make(map[uint64]wheelItem)
+
+	return expired
 }
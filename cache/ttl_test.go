@@ -1,39 +1,101 @@
 package cache
 
 import (
-	"fmt"
 	"testing"
 	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
 )
 
-type mockStore struct {
-	store
+func TestClean(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s := newTimingWheel(clk, 10*time.Millisecond)
+
+	hashKey, conflict := KeyToHash("ayang")
+	hashKey1, conflict1 := KeyToHash("tom")
+	s.Add(hashKey, conflict, clk.Now().Add(time.Millisecond))
+	s.Add(hashKey1, conflict1, clk.Now().Add(100*time.Millisecond))
+
+	clk.Add(30 * time.Millisecond)
+	expired := s.Clean()
+	if len(expired) != 1 || expired[hashKey] != conflict {
+		t.Fatalf("expired %v, want only ayang", expired)
+	}
+
+	clk.Add(100 * time.Millisecond)
+	expired = s.Clean()
+	if len(expired) != 1 || expired[hashKey1] != conflict1 {
+		t.Fatalf("expired %v, want only tom", expired)
+	}
+
+	if expired = s.Clean(); len(expired) != 0 {
+		t.Fatalf("expired %v, want empty", expired)
+	}
 }
 
-type mockPolicy struct {
-	policy
+func TestTimingWheel_Cascade(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s := newTimingWheel(clk, 10*time.Millisecond)
+	start := clk.Now()
+
+	// tick 为 10 毫秒时分别在第 0、1、2、3 层
+	ttls := []time.Duration{100 * time.Millisecond, 10 * time.Second, 10 * time.Minute, 2 * time.Hour}
+	for i, ttl := range ttls {
+		s.Add(uint64(i+1), uint64(i+1), start.Add(ttl))
+	}
+
+	for i, ttl := range ttls {
+		// 到期前一个 tick 不会被清理
+		clk.Set(start.Add(ttl - 10*time.Millisecond))
+		if expired := s.Clean(); len(expired) != 0 {
+			t.Fatalf("ttl %v: expired %v too early", ttl, expired)
+		}
+
+		clk.Set(start.Add(ttl + 10*time.Millisecond))
+		expired := s.Clean()
+		if len(expired) != 1 || expired[uint64(i+1)] != uint64(i+1) {
+			t.Fatalf("ttl %v: expired %v, want %d", ttl, expired, i+1)
+		}
+	}
 }
 
-// Del 覆盖方法，编译时会自动选择最近的，也就是这个方法
-func (*mockStore) Del(hashKey uint64, conflict uint64) (interface{}, bool) {
-	fmt.Printf("Del hashKey:%d conflict:%d\n", hashKey, conflict)
-	return nil, false
+// TestTimingWheel_CatchUp 错过了很多个 tick 也不会漏掉
+func TestTimingWheel_CatchUp(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s := newTimingWheel(clk, time.Millisecond)
+
+	now := clk.Now()
+	for i := uint64(1); i <= 100; i++ {
+		s.Add(i, i, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	// 已经过期的下次 Clean 直接返回
+	s.Add(101, 101, now.Add(-time.Second))
+
+	clk.Add(150 * time.Millisecond)
+	if expired := s.Clean(); len(expired) != 101 {
+		t.Fatalf("expired %d keys, want 101", len(expired))
+	}
 }
 
-func (mockPolicy) Del(uint64) {}
+func TestTimingWheel_UpdateDel(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s := newTimingWheel(clk, time.Millisecond)
 
-func TestClean(t *testing.T) {
-	s := newExpirationMap()
+	now := clk.Now()
+	s.Add(1, 1, now.Add(5*time.Millisecond))
+	s.Add(2, 2, now.Add(5*time.Millisecond))
+	s.Add(3, 3, now.Add(5*time.Millisecond))
+	s.Update(1, 1, now.Add(5*time.Millisecond), now.Add(time.Hour))
+	s.Del(2, now.Add(5*time.Millisecond))
 
-	hashKey, conflict := KeyToHash("ayang")
-	hashKey1, conflict1 := KeyToHash("tom")
-	s.Add(hashKey, conflict, time.Now().Add(time.Millisecond))
-	s.Add(hashKey1, conflict1, time.Now().Add(time.Duration(secondsPerBucket)*time.Second))
-
-	for i := 0; i < 4; i++ {
-		time.Sleep(time.Duration(secondsPerBucket) * time.Second)
-		// 代码量少，且没有其他协程抢占，时间都是准的，所有极大概率会在第 2 和第 3 次各删除一个
-		println(i)
-		s.Clean(&mockStore{}, mockPolicy{})
+	clk.Add(20 * time.Millisecond)
+	expired := s.Clean()
+	if len(expired) != 1 || expired[3] != 3 {
+		t.Fatalf("expired %v, want 3", expired)
+	}
+
+	s.Clear()
+	if len(s.where) != 0 {
+		t.Fatalf("where has %d keys after Clear", len(s.where))
 	}
 }
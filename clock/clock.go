@@ -0,0 +1,125 @@
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock 所有依赖时间的地方（过期判断、定期清理、超时）都通过它获取时间，而不是直接调用 time 包
+// 这样测试时可以换成 Fake，手动推进时间，不需要真的 sleep
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker 同 time.Ticker，只是 C 改成了方法
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer 同 time.Timer，只是 C 改成了方法
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Real 直接使用 time 包
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// Since 同 time.Since
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Until 同 time.Until
+func Until(c Clock, t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+// WithTimeout 同 context.WithTimeout，但超时由 c 决定，c 为 Real 时就是 context.WithTimeout
+func WithTimeout(parent context.Context, c Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := c.(realClock); ok {
+		return context.WithTimeout(parent, timeout)
+	}
+
+	deadline := c.Now().Add(timeout)
+	// parent 更早超时，不需要再开定时器
+	if d, ok := parent.Deadline(); ok && !d.After(deadline) {
+		return context.WithCancel(parent)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	dc := &deadlineCtx{
+		Context:  ctx,
+		deadline: deadline,
+	}
+
+	timer := c.NewTimer(timeout)
+	go func() {
+		select {
+		case <-timer.C():
+			dc.mutex.Lock()
+			dc.err = context.DeadlineExceeded
+			dc.mutex.Unlock()
+			cancel()
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}()
+
+	return dc, cancel
+}
+
+// deadlineCtx Deadline 返回的是 Clock 的时间，超时后 Err 返回 context.DeadlineExceeded
+type deadlineCtx struct {
+	context.Context
+	deadline time.Time
+	mutex    sync.Mutex
+	err      error
+}
+
+func (ctx *deadlineCtx) Deadline() (time.Time, bool) {
+	return ctx.deadline, true
+}
+
+func (ctx *deadlineCtx) Err() error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.err != nil {
+		return ctx.err
+	}
+	return ctx.Context.Err()
+}
@@ -0,0 +1,99 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFake_Timer(t *testing.T) {
+	f := NewFake(time.Time{})
+	start := f.Now()
+
+	timer := f.NewTimer(time.Second)
+	f.Add(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired too early")
+	default:
+	}
+
+	f.Add(time.Millisecond)
+	select {
+	case now := <-timer.C():
+		if now.Sub(start) != time.Second {
+			t.Fatalf("fired at %v, want 1s", now.Sub(start))
+		}
+	default:
+		t.Fatal("timer should fire")
+	}
+
+	if timer.Stop() {
+		t.Fatal("Stop should return false after fired")
+	}
+	if f.Timers() != 0 {
+		t.Fatalf("Timers = %d, want 0", f.Timers())
+	}
+}
+
+func TestFake_Ticker(t *testing.T) {
+	f := NewFake(time.Time{})
+	ticker := f.NewTicker(10 * time.Millisecond)
+
+	n := 0
+	for i := 0; i < 5; i++ {
+		f.Add(10 * time.Millisecond)
+		select {
+		case <-ticker.C():
+			n++
+		default:
+		}
+	}
+	if n != 5 {
+		t.Fatalf("ticked %d times, want 5", n)
+	}
+
+	// 一次推进很多个周期，只会收到一个
+	f.Add(time.Hour)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("extra tick")
+	default:
+	}
+
+	ticker.Stop()
+	f.Add(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker fired after Stop")
+	default:
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	f := NewFake(time.Time{})
+	ctx, cancel := WithTimeout(context.Background(), f, time.Second)
+	defer cancel()
+
+	if d, ok := ctx.Deadline(); !ok || Until(f, d) != time.Second {
+		t.Fatalf("Deadline = %v, %v", d, ok)
+	}
+
+	f.Add(time.Second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("ctx should be done")
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("Err = %v, want DeadlineExceeded", ctx.Err())
+	}
+
+	// 手动取消的是 Canceled
+	ctx, cancel = WithTimeout(context.Background(), f, time.Second)
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("Err = %v, want Canceled", ctx.Err())
+	}
+}
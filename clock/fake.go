@@ -0,0 +1,148 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake 手动推进的时钟，只有调用 Add 或 Set 时时间才会改变，到期的 Timer 和 Ticker 也在这时触发
+// 和 time 包一样，C 的缓冲为 1，接收方来不及接收时多出来的 tick 会被丢弃
+type Fake struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake 从 now 开始，now 为零值时从当前时间开始
+func NewFake(now time.Time) *Fake {
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Add 推进 d，并按到期时间的顺序触发期间到期的 Timer 和 Ticker
+func (f *Fake) Add(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set 推进到 t，t 比现在早则什么都不做
+func (f *Fake) Set(t time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for {
+		sort.Slice(f.timers, func(i, j int) bool {
+			return f.timers[i].when.Before(f.timers[j].when)
+		})
+		if len(f.timers) == 0 || f.timers[0].when.After(t) {
+			break
+		}
+
+		timer := f.timers[0]
+		if f.now.Before(timer.when) {
+			f.now = timer.when
+		}
+		timer.fire(f.now)
+		if timer.period > 0 {
+			// 一次推进了很多个周期，C 的缓冲只有 1，中间的 tick 反正都会被丢弃，直接跳到 t 之后
+			timer.when = timer.when.Add(timer.period)
+			if !timer.when.After(t) {
+				timer.when = timer.when.Add((t.Sub(timer.when)/timer.period + 1) * timer.period)
+			}
+		} else {
+			f.timers = f.timers[1:]
+		}
+	}
+
+	if f.now.Before(t) {
+		f.now = t
+	}
+}
+
+// Timers 还没有到期（或停止）的 Timer 和 Ticker 的数量，测试时用来确认对方已经开始等待了
+func (f *Fake) Timers() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.timers)
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.newTimer(d, d)}
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.newTimer(d, 0)
+}
+
+func (f *Fake) newTimer(d, period time.Duration) *fakeTimer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	timer := &fakeTimer{
+		clock:  f,
+		c:      make(chan time.Time, 1),
+		when:   f.now.Add(d),
+		period: period,
+	}
+	if d <= 0 {
+		timer.fire(f.now)
+		return timer
+	}
+	f.timers = append(f.timers, timer)
+	return timer
+}
+
+// remove 返回是否还在等待，调用方需要上锁
+func (f *Fake) remove(timer *fakeTimer) bool {
+	for i := range f.timers {
+		if f.timers[i] == timer {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock *Fake
+	c     chan time.Time
+	when  time.Time
+	// 大于 0 表示 Ticker
+	period time.Duration
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.remove(t)
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
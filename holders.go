@@ -0,0 +1,72 @@
+package ayangcache
+
+import "sync"
+
+// minHoldersSweep holders 中的 key 少于这个数量时不清理
+const minHoldersSweep = 1024
+
+// holders 记录本节点作为所属节点时，哪些节点从本节点获取过 key（即通过 populateCache 保存了副本）
+// 修改或删除 key 时，需要通知这些节点删除副本，否则它们会一直返回旧值
+// 通知过后就删除记录；key 的数量每增长一倍就清理一次不在主缓存中的 key（被淘汰、过期或者没有通过准入），
+// 所以最多是主缓存的 key 的两倍左右。清理掉的 key 如果其他节点还有副本，修改时就不会通知它们，只能等它们自己淘汰
+type holders struct {
+	mutex sync.Mutex
+	// map(key, set(节点地址))
+	m map[string]map[string]struct{}
+	// 判断 key 是否还在主缓存中
+	exists func(key string) bool
+	// key 的数量达到 next 时清理
+	next int
+}
+
+func newHolders(exists func(key string) bool) *holders {
+	return &holders{
+		m:      make(map[string]map[string]struct{}),
+		exists: exists,
+		next:   minHoldersSweep,
+	}
+}
+
+func (h *holders) add(key, addr string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	addrs, ok := h.m[key]
+	if !ok {
+		addrs = make(map[string]struct{})
+		h.m[key] = addrs
+	}
+	addrs[addr] = struct{}{}
+
+	if len(h.m) >= h.next {
+		h.sweep(key)
+	}
+}
+
+// sweep 删除不在主缓存中的 key，调用方需要上锁
+// 刚加入的 key 不检查，加入主缓存是异步的，此时可能还没有处理
+func (h *holders) sweep(current string) {
+	for key := range h.m {
+		if key != current && !h.exists(key) {
+			delete(h.m, key)
+		}
+	}
+	h.next = 2 * len(h.m)
+	if h.next < minHoldersSweep {
+		h.next = minHoldersSweep
+	}
+}
+
+// take 返回并删除 key 的所有副本节点
+func (h *holders) take(key string) []string {
+	h.mutex.Lock()
+	addrs := h.m[key]
+	delete(h.m, key)
+	h.mutex.Unlock()
+
+	res := make([]string, 0, len(addrs))
+	for addr := range addrs {
+		res = append(res, addr)
+	}
+	return res
+}
@@ -9,6 +9,8 @@ const (
 type Peer interface {
 	// GetPeer 获取分布式节点，"" 表示本节点
 	GetPeer(key string) string
+	// Close 从注册中心注销本节点，并停止监听节点变化
+	Close()
 }
 
 type peer struct {
@@ -18,6 +20,9 @@ type peer struct {
 	m    *Map
 	// 注册中心
 	register RegistrationCenterClient
+	closeDo  sync.Once
+	// 监听协程退出后 close
+	done chan struct{}
 }
 
 func NewPeer(localAddr, registerAddr string) Peer {
@@ -25,19 +30,18 @@ func NewPeer(localAddr, registerAddr string) Peer {
 		addr:     localAddr,
 		m:        NewMap(virtualPeerNum, nil),
 		register: NewEtcdRegistrationCenterClient(localAddr, registerAddr),
+		done:     make(chan struct{}),
 	}
 
 	// 阻塞等待服务注册和第一次
 	notifyChan := p.register.Notify()
 	p.initPeers(<-notifyChan...)
 
-	// 后面监听
+	// 后面监听，注册中心关闭后 notifyChan 会被 close
 	go func() {
-		for {
-			select {
-			case nodes := <-notifyChan:
-				p.initPeers(nodes...)
-			}
+		defer close(p.done)
+		for nodes := range notifyChan {
+			p.initPeers(nodes...)
 		}
 	}()
 	return p
@@ -61,3 +65,10 @@ func (p *peer) GetPeer(key string) string {
 
 	return ""
 }
+
+func (p *peer) Close() {
+	p.closeDo.Do(func() {
+		p.register.Close()
+		<-p.done
+	})
+}
@@ -86,6 +86,8 @@ func (rcc *etcdRegistrationCenterClient) Close() {
 	rcc.unRegister()
 	// close notifyChan
 	rcc.notifyClose()
+	// 关闭与 etcd 的连接
+	_ = rcc.etcdClient.Close()
 }
 
 func (rcc *etcdRegistrationCenterClient) register(etcdClient *clientv3.Client, NodeSeq int, addr addr) context.CancelFunc {
@@ -0,0 +1,127 @@
+package ayangcache
+
+import (
+	"context"
+	"fmt"
+	"github.com/ayanghuang/ayangcache/byteview"
+	"github.com/ayanghuang/ayangcache/peer"
+	"github.com/ayanghuang/ayangcache/transport"
+	"sync"
+	"time"
+)
+
+var (
+	nodeMu sync.RWMutex
+	// 本节点，所有 Group 共用。为 nil 表示没有注册，此时所有 Group 都只从本地数据源获取
+	localNode *node
+)
+
+// node 本节点的分布式组件
+// 为什么不像以前一样每个 Group 一个？因为一个进程只需要监听一个端口、在注册中心注册一次，
+// 请求中带上 Group 的名字，由服务端分发给对应的 Group 即可
+type node struct {
+	addr string
+	// 获取远程节点信息
+	peers peer.Peer
+	// 即是客户端（内部又有服务端），负责发送请求
+	client transport.Transport
+}
+
+// RegisterPeers 开启本节点的服务端，并注册到注册中心，只能调用一次（所有 Group 都 Close 后可以再次调用）
+// addr 为本节点地址，registerAddr 为注册中心地址，codecType 为编码方式
+func RegisterPeers(addr, registerAddr, codecType string) {
+	nodeMu.Lock()
+	defer nodeMu.Unlock()
+
+	if localNode != nil {
+		panic("RegisterPeers called more than once")
+	}
+
+	n := &node{addr: addr}
+	// 先开启服务端，再注册到注册中心，否则其他节点发现了本节点却可能连接不上
+	n.client = transport.NewTransport(addr, codecType, handler{})
+	n.peers = peer.NewPeer(addr, registerAddr)
+
+	localNode = n
+}
+
+// closeNode 按顺序关闭本节点，之后可以重新调用 RegisterPeers
+func closeNode() {
+	nodeMu.Lock()
+	n := localNode
+	localNode = nil
+	nodeMu.Unlock()
+
+	if n == nil {
+		return
+	}
+
+	// 先注销，其他节点就不会再把请求发过来了
+	n.peers.Close()
+	// 再关闭服务端（等待正在处理的请求）和客户端
+	n.client.Close()
+}
+
+func getNode() *node {
+	nodeMu.RLock()
+	n := localNode
+	nodeMu.RUnlock()
+	return n
+}
+
+// handler 服务端收到请求后，根据 Group 的名字分发给对应的 Group
+type handler struct{}
+
+func (handler) Get(ctx context.Context, group, key, from string) (byteview.ByteView, error) {
+	g, err := findGroup(group)
+	if err != nil {
+		return byteview.ByteView{}, err
+	}
+
+	val, err := g.Get(ctx, key)
+	// 对方会把值保存为副本，记录下来，修改时需要通知它
+	if err == nil && from != "" {
+		g.holders.add(key, from)
+	}
+	return val, err
+}
+
+func (handler) Set(ctx context.Context, group, key string, value []byte, ttl time.Duration) error {
+	g, err := findGroup(group)
+	if err != nil {
+		return err
+	}
+
+	g.setLocally(ctx, key, byteview.NewByteView(value), ttl)
+	return nil
+}
+
+func (handler) Remove(ctx context.Context, group, key string) error {
+	g, err := findGroup(group)
+	if err != nil {
+		return err
+	}
+
+	g.removeLocally(ctx, key)
+	return nil
+}
+
+func (handler) Invalidate(_ context.Context, group, key string) error {
+	g, err := findGroup(group)
+	if err != nil {
+		return err
+	}
+
+	g.removeFromCache(key)
+	return nil
+}
+
+// findGroup 找到 Group 并记录一次服务端请求
+func findGroup(name string) (*Group, error) {
+	g := GetGroup(name)
+	if g == nil {
+		return nil, fmt.Errorf("no such group: %s", name)
+	}
+	g.stats.serverRequests.Add(1)
+	return g, nil
+}
@@ -0,0 +1,90 @@
+package ayangcache
+
+import (
+	"github.com/ayanghuang/ayangcache/byteview"
+	"github.com/ayanghuang/ayangcache/cache"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// snapshotCodec key 就是字符串本身，value 就是 ByteView 的字节
+var snapshotCodec = cache.SnapshotCodec[string, byteview.ByteView]{
+	EncodeKey: func(key string) ([]byte, error) {
+		return []byte(key), nil
+	},
+	DecodeKey: func(b []byte) (string, error) {
+		return string(b), nil
+	},
+	EncodeValue: func(value byteview.ByteView) ([]byte, error) {
+		return value.ByteSlice(), nil
+	},
+	DecodeValue: func(b []byte) (byteview.ByteView, error) {
+		return byteview.NewByteView(b), nil
+	},
+}
+
+// valueCodec L2 和 slab store 中 value 的编码方式，同 snapshotCodec
+var valueCodec = cache.ValueCodec[byteview.ByteView]{
+	Encode: snapshotCodec.EncodeValue,
+	Decode: snapshotCodec.DecodeValue,
+}
+
+// loadSnapshot 启动时加载快照，文件不存在说明是第一次启动，其他错误只打印日志，不影响启动
+// 快照中 key 的 hash 会重新计算，所以和保存时是不是同一个进程无关
+func (g *Group) loadSnapshot() {
+	if g.snapshotPath == "" {
+		return
+	}
+
+	f, err := os.Open(g.snapshotPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(g.name, "open snapshot failed:", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	n, err := g.mainCache.LoadSnapshot(f, snapshotCodec)
+	if err != nil {
+		log.Println(g.name, "load snapshot failed:", err)
+	}
+	log.Println(g.name, "loaded", n, "keys from snapshot", g.snapshotPath)
+}
+
+// saveSnapshot 关闭时保存快照，只保存当前 peer.Map 下仍然属于本节点的 key，其他的 key 重启后也不会再请求到本节点
+// 先写到临时文件再 rename，保存到一半进程退出了也不会破坏上一次的快照
+func (g *Group) saveSnapshot() {
+	if g.snapshotPath == "" {
+		return
+	}
+
+	n := getNode()
+	own := func(key string) bool {
+		// 没有注册时所有的 key 都属于本节点
+		return n == nil || n.peers.GetPeer(key) == ""
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(g.snapshotPath), filepath.Base(g.snapshotPath)+".tmp*")
+	if err != nil {
+		log.Println(g.name, "create snapshot failed:", err)
+		return
+	}
+	tmp := f.Name()
+
+	err = g.mainCache.SaveSnapshot(f, snapshotCodec, own)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, g.snapshotPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Println(g.name, "save snapshot failed:", err)
+	}
+}
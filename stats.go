@@ -0,0 +1,54 @@
+package ayangcache
+
+import "sync/atomic"
+
+// Stats Group 的统计信息快照，可以直接序列化导出（例如 json、expvar）
+type Stats struct {
+	// Gets 调用 Get 的次数（包括远程节点的请求）
+	Gets int64 `json:"gets"`
+	// CacheHits 主缓存或热点缓存命中的次数
+	CacheHits int64 `json:"cache_hits"`
+	// Loads 缓存没有命中的次数，即 Gets - CacheHits
+	Loads int64 `json:"loads"`
+	// LoadsDeduped 经过 singleflight 合并后真正执行加载的次数
+	LoadsDeduped int64 `json:"loads_deduped"`
+	// PeerLoads 从远程节点获取成功的次数
+	PeerLoads int64 `json:"peer_loads"`
+	// PeerErrors 从远程节点获取失败的次数
+	PeerErrors int64 `json:"peer_errors"`
+	// LocalLoads 从本地数据源（Getter）获取成功的次数
+	LocalLoads int64 `json:"local_loads"`
+	// LocalLoadErrs 从本地数据源（Getter）获取失败的次数
+	LocalLoadErrs int64 `json:"local_load_errs"`
+	// ServerRequests 本节点服务端处理的该 Group 的请求数（包括 Get、Set 等）
+	ServerRequests int64 `json:"server_requests"`
+}
+
+// stats 各个计数器，都是原子操作，没有锁，热路径上也可以放心调用
+type stats struct {
+	gets           atomic.Int64
+	cacheHits      atomic.Int64
+	loads          atomic.Int64
+	loadsDeduped   atomic.Int64
+	peerLoads      atomic.Int64
+	peerErrors     atomic.Int64
+	localLoads     atomic.Int64
+	localLoadErrs  atomic.Int64
+	serverRequests atomic.Int64
+}
+
+// Stats 返回统计信息快照
+// 注意：各个计数器是分别读取的，并不是同一时刻的值，所以可能会有微小的不一致
+func (g *Group) Stats() Stats {
+	return Stats{
+		Gets:           g.stats.gets.Load(),
+		CacheHits:      g.stats.cacheHits.Load(),
+		Loads:          g.stats.loads.Load(),
+		LoadsDeduped:   g.stats.loadsDeduped.Load(),
+		PeerLoads:      g.stats.peerLoads.Load(),
+		PeerErrors:     g.stats.peerErrors.Load(),
+		LocalLoads:     g.stats.localLoads.Load(),
+		LocalLoadErrs:  g.stats.localLoadErrs.Load(),
+		ServerRequests: g.stats.serverRequests.Load(),
+	}
+}
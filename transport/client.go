@@ -25,8 +25,12 @@ type client struct {
 	singleCreateConn singleflight.Group
 	// 编码格式
 	codec NewCodecFunc
+	// 关闭后不再建立新的连接
+	closed bool
 }
 
+var errClientClosed = errors.New("client closed")
+
 func newClient(codecFunc NewCodecFunc) *client {
 	return &client{
 		connMap:          make(map[string]*peerConn),
@@ -90,15 +94,46 @@ func (c *client) removeConn(addr string) {
 	c.rw.Unlock()
 }
 
-func (c *client) addConnToMap(addr string, conn *peerConn) {
+// addConnToMap 已经关闭则返回 false，由调用方关闭这个连接
+func (c *client) addConnToMap(addr string, conn *peerConn) bool {
 	c.rw.Lock()
+	defer c.rw.Unlock()
+	if c.closed {
+		return false
+	}
 	c.connMap[addr] = conn
+	return true
+}
+
+// close 关闭所有连接，正在等待 response 的请求会立刻返回错误
+func (c *client) close() {
+	c.rw.Lock()
+	c.closed = true
+	conns := make([]*peerConn, 0, len(c.connMap))
+	for _, conn := range c.connMap {
+		conns = append(conns, conn)
+	}
 	c.rw.Unlock()
+
+	// peerConn.close 会调用 removeConn 加锁，所以不能在锁内关闭
+	for _, conn := range conns {
+		conn.close()
+	}
+}
+
+func (c *client) isClosed() bool {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.closed
 }
 
 func (c *client) createConn(addr string) (*peerConn, error) {
 	// 利用 singleFlight 进行一次创建连接
 	p, err := c.singleCreateConn.Do(addr, func() (interface{}, error) {
+		if c.isClosed() {
+			return nil, errClientClosed
+		}
+
 		// 再检查一遍
 		conn := c.getConnFromMap(addr)
 		if conn != nil {
@@ -112,7 +147,10 @@ func (c *client) createConn(addr string) (*peerConn, error) {
 		}
 
 		// 加入客户端的连接池中
-		c.addConnToMap(addr, conn)
+		if !c.addConnToMap(addr, conn) {
+			conn.close()
+			return nil, errClientClosed
+		}
 		return conn, nil
 	})
 
@@ -201,6 +239,11 @@ func (conn *peerConn) writeLoop() {
 			}
 
 			err = conn.codec.WriteRequest(req)
+			if err == errFrameTooLarge {
+				// 什么都没有写入，只让这个请求失败，不影响连接上的其他请求
+				conn.failCall(req.Seq, err)
+				continue
+			}
 			if err != nil {
 				// 这里为了简单，有任何错误（eg：EOF（对方 close TCP），我方序列化错误等），直接关闭连接
 				log.Println("writeLoop error:", err.Error())
@@ -263,7 +306,9 @@ func (conn *peerConn) send(c *call) {
 	// 什么时候应该把 call 从 map 中删除呢？
 	// 1. 在读 response 后找到后删除
 	// 2. 超时，两种情况（1）己方发不过去（2）对方没发过来
-	conn.addCall(c)
+	if !conn.addCall(c) {
+		return
+	}
 
 	// 还是必须非阻塞，可能已经关闭该 conn（关闭该 conn 怎么走到这里？因为关闭前就已经获得 conn 了，走到这里的中间被关闭了 ）
 	// 那要是
@@ -289,11 +334,22 @@ func (conn *peerConn) removeCall(seq uint64) {
 	conn.callMutex.Unlock()
 }
 
-func (conn *peerConn) addCall(c *call) {
+// addCall 连接已经关闭（calls 已被清空）则直接唤醒请求并返回 false
+func (conn *peerConn) addCall(c *call) bool {
 	conn.callMutex.Lock()
+	if conn.calls == nil {
+		conn.callMutex.Unlock()
+		c.err = errors.New("with " + conn.serverAddr + " connection has closed")
+		select {
+		case c.valCh <- nil:
+		default:
+		}
+		return false
+	}
 	conn.calls[c.Seq] = c
 	log.Println("peerConn addCall", "seq:", c.Seq, "key:", c.Key)
 	conn.callMutex.Unlock()
+	return true
 }
 
 func (conn *peerConn) searchCall(seq uint64) *call {
@@ -307,6 +363,19 @@ func (conn *peerConn) searchCall(seq uint64) *call {
 	return call
 }
 
+// failCall 唤醒 seq 对应的请求并返回 err
+func (conn *peerConn) failCall(seq uint64, err error) {
+	call := conn.searchCall(seq)
+	if call == nil {
+		return
+	}
+	call.err = err
+	select {
+	case call.valCh <- nil:
+	default:
+	}
+}
+
 func (conn *peerConn) clearCalls() {
 	conn.callMutex.Lock()
 	// 唤醒所有阻塞等待返回的请求协程
@@ -9,12 +9,18 @@ func TestJsonCodec_WriteRequest_ReadRequestBody(t *testing.T) {
 	c := NewJsonCodec(stream)
 
 	req1 := &RequestBody{
-		Seq: 1,
-		Key: "ayang",
+		Seq:   1,
+		Key:   "ayang",
+		Group: "scores",
 	}
 	req2 := &RequestBody{
-		Seq: 2,
-		Key: "tom",
+		Seq:   2,
+		Key:   "tom",
+		Group: "scores",
+		Op:    OpSet,
+		Value: []byte("tomValue"),
+		TTL:   1000,
+		From:  "127.0.0.1:5555",
 	}
 
 	_ = c.WriteRequest(req1)
@@ -26,11 +32,12 @@ func TestJsonCodec_WriteRequest_ReadRequestBody(t *testing.T) {
 	_ = c.ReadRequestBody(req11)
 	_ = c.ReadRequestBody(req22)
 
-	if req1.Seq == req11.Seq && req1.Key == req11.Key {
+	if req1.Seq == req11.Seq && req1.Key == req11.Key && req1.Group == req11.Group {
 	} else {
 		t.Error("error")
 	}
-	if req2.Seq == req22.Seq && req2.Key == req22.Key {
+	if req2.Seq == req22.Seq && req2.Key == req22.Key && req2.Group == req22.Group &&
+		req2.Op == req22.Op && string(req2.Value) == string(req22.Value) && req2.TTL == req22.TTL && req2.From == req22.From {
 	} else {
 		t.Error("error")
 	}
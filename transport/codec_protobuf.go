@@ -12,8 +12,13 @@ const (
 	// 采用 protobuf 编码的话，前 2 个字节为 body 长度，后面则为采用 protobuf 编码后的 body
 	// 注意：如果采用 json 编码，传长度，因为 json 能自动识别出边界
 	frameLength = 2
+	// maxFrameSize 2 个字节能表示的最大 body 长度
+	maxFrameSize = 1<<16 - 1
 )
 
+// errFrameTooLarge body 超过 maxFrameSize，长度会溢出，对方按错误的长度读就会把后面的数据全部读乱
+var errFrameTooLarge = errors.New("frame is larger than 64KB")
+
 type ProtobufCodec struct {
 	conn    io.ReadWriter
 	readBuf *bufio.Reader
@@ -86,6 +91,12 @@ func (proto *ProtobufCodec) ReadRequestBody(body *RequestBody) error {
 
 	body.Seq = pBody.GetSeq()
 	body.Key = pBody.GetKey()
+	body.Group = pBody.GetGroup()
+	body.Timeout = pBody.GetTimeout()
+	body.Op = pBody.GetOp()
+	body.Value = pBody.GetValue()
+	body.TTL = pBody.GetTtl()
+	body.From = pBody.GetFrom()
 
 	return nil
 
@@ -130,15 +141,24 @@ func (proto *ProtobufCodec) WriteRequest(body *RequestBody) error {
 
 	var err error
 	message := &protobuf.RequestBody{
-		Seq: body.Seq,
-		Key: body.Key,
+		Seq:     body.Seq,
+		Key:     body.Key,
+		Group:   body.Group,
+		Timeout: body.Timeout,
+		Op:      body.Op,
+		Value:   body.Value,
+		Ttl:     body.TTL,
+		From:    body.From,
 	}
 
-	// 需要验证大小，超出 16 bit 不行，这里就不处理了
 	bytes, err := protoG.Marshal(message)
 	if err != nil {
 		return err
 	}
+	// 在写入之前检查，什么都没写，连接还可以继续使用
+	if len(bytes) > maxFrameSize {
+		return errFrameTooLarge
+	}
 
 	lenBytes := uint16ToBytes(uint16(len(bytes)))
 
@@ -162,11 +182,14 @@ func (proto *ProtobufCodec) WriteResponse(body *ResponseBody) error {
 		Err:   body.Err,
 	}
 
-	// 需要验证大小，超出 16 bit 不行。简单一点，这里就不处理了。
 	bytes, err := protoG.Marshal(message)
 	if err != nil {
 		return err
 	}
+	// 在写入之前检查，什么都没写，连接还可以继续使用
+	if len(bytes) > maxFrameSize {
+		return errFrameTooLarge
+	}
 
 	lenBytes := uint16ToBytes(uint16(len(bytes)))
 
@@ -1,8 +1,31 @@
 package transport
 
+// 请求的操作类型，OpGet 为 0，这样没有 Op 字段的旧请求也是 Get
+const (
+	OpGet uint32 = iota
+	// OpSet 发送给 key 的所属节点，修改缓存
+	OpSet
+	// OpRemove 发送给 key 的所属节点，删除缓存
+	OpRemove
+	// OpInvalidate 所属节点发送给保存了副本的节点，删除副本
+	OpInvalidate
+)
+
 type RequestBody struct {
 	Seq uint64 `json:"seq"`
 	Key string `json:"key"`
+	// Group 请求的 Group 名字，服务端根据它分发给对应的 Group
+	Group string `json:"group"`
+	// Timeout 调用方剩余的超时时间（毫秒），服务端超过这个时间就不再处理，也不再发送 response
+	// 传剩余时间而不是截止时间点，是因为不同节点的时钟不一定一致
+	Timeout int64 `json:"timeout"`
+	// Op 操作类型，见 OpGet 等
+	Op uint32 `json:"op"`
+	// Value 和 TTL（毫秒）只有 OpSet 才有
+	Value []byte `json:"value"`
+	TTL   int64  `json:"ttl"`
+	// From 请求方节点的地址，所属节点据此记录哪些节点保存了副本
+	From string `json:"from"`
 }
 
 type ResponseBody struct {
@@ -1,7 +1,11 @@
 package transport
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/ayanghuang/ayangcache/byteview"
+	"github.com/ayanghuang/ayangcache/clock"
 	"github.com/panjf2000/ants/v2"
 	"log"
 	"net"
@@ -23,55 +27,149 @@ func init() {
 	}
 }
 
-// GetValueFunc 做法一
-type GetValueFunc func(string) (byteview.ByteView, error)
+// 做法一：以前只有 Get 一种请求时，传入的是一个函数类型
+// type GetValueFunc func(ctx context.Context, group, key string) (byteview.ByteView, error)
+
+// Handler 做法二：在本包增加一个接口（为什么不直接用 ayangcache 包的接口，还要造一个新的接口，因为会造成循环依赖）
+// 然后在 server 创建时传入作为 server 的 field。现在有 Get、Set 等多种请求，一个函数不够用了，所以改为了这种做法
+// 所有方法的 ctx 都带有调用方剩余的超时时间
+type Handler interface {
+	// Get from 为请求方节点的地址，所属节点据此记录哪些节点保存了副本
+	Get(ctx context.Context, group, key, from string) (byteview.ByteView, error)
+	// Set 修改缓存，ttl 为 0 表示不过期
+	Set(ctx context.Context, group, key string, value []byte, ttl time.Duration) error
+	// Remove 删除缓存
+	Remove(ctx context.Context, group, key string) error
+	// Invalidate 删除本节点保存的副本
+	Invalidate(ctx context.Context, group, key string) error
+}
 
-// 做法二：在本包增加一个 Get(key string) (byteview.ByteView, error)（为什么不直接用 ayangcache 包的接口，还要造一个新的接口，因为会造成循环依赖）
-// 然后在 server 创建时把 Group 传入作为 server 的 file（该字段的类型是具有 Get 方法的接口）
-//type GetValueFunc interface {
-//	Get(key string) (byteview.ByteView, error)
-//}
+var errServerClosed = errors.New("server closed")
 
 type server struct {
 	// 本节点地址
 	addr string
 	// 编码格式
 	codec NewCodecFunc
-	// 从本节点获取缓存
-	getValueFunc GetValueFunc
+	// 处理请求，从本节点获取或修改缓存
+	handler Handler
+	// 计算处理请求的超时时间
+	clock clock.Clock
+	// 保护下面的字段
+	mutex    sync.Mutex
+	listener net.Listener
+	// 所有的客户端连接，关闭时需要逐个关闭
+	conns map[*clientConn]struct{}
+	// 正在处理的请求，关闭时等待它们处理完
+	inFlight sync.WaitGroup
+	closed   bool
 }
 
-func newServer(addr string, codec NewCodecFunc, getValueFunc GetValueFunc) *server {
+func newServer(addr string, codec NewCodecFunc, handler Handler) *server {
 	server := &server{
-		addr:         addr,
-		codec:        codec,
-		getValueFunc: getValueFunc,
+		addr:    addr,
+		codec:   codec,
+		handler: handler,
+		clock:   clock.Real,
+		conns:   make(map[*clientConn]struct{}),
 	}
 	return server
 }
 
 func (s *server) Serve() {
-	server, err := net.Listen("tcp", s.addr)
-	defer func() {
-		_ = server.Close()
-	}()
-
+	s.mutex.Lock()
+	// 还没开始监听就被关闭了
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
+		s.mutex.Unlock()
 		panic("server start fail")
 	}
+	s.listener = listener
+	s.mutex.Unlock()
 
 	for {
-		var err error
 		// 等待客户端连接
-		conn, err := server.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("server err:", err.Error())
+			if !s.isClosed() {
+				log.Println("server err:", err.Error())
+			}
+			return
+		}
+
+		if !s.addConn(newClientConn(conn, s)) {
 			return
 		}
+	}
+}
+
+// Close 优雅关闭：停止监听，不再接收新的请求，等待正在处理的请求发送完 response 后再关闭所有连接
+func (s *server) Close() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.mutex.Unlock()
+
+	// closed 之后不会再有新的请求加入 inFlight，所以这里的 Wait 是安全的
+	// 每个请求都有超时时间，所以不会等太久
+	s.inFlight.Wait()
+
+	s.mutex.Lock()
+	conns := make([]*clientConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.flushAndClose()
+	}
+}
+
+func (s *server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// addConn 已经关闭则直接关闭这个连接，返回 false
+func (s *server) addConn(conn *clientConn) bool {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		conn.close()
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.mutex.Unlock()
+	return true
+}
 
-		_ = newClientConn(conn, s)
+func (s *server) removeConn(conn *clientConn) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.mutex.Unlock()
+}
 
+// startRequest 登记一个正在处理的请求，已经关闭则返回 false
+func (s *server) startRequest() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
 	}
+	s.inFlight.Add(1)
+	return true
 }
 
 type clientConn struct {
@@ -89,14 +187,20 @@ type clientConn struct {
 	// 2. 读 closed 的 chan 会直接返回零值
 	// 2. 写 closed 的 chan 会 panic，注意即使采用 select 非阻塞写 close 的 chan 也会 panic
 	closeCh chan struct{}
+	// 所有请求的 ctx 都派生自它，连接关闭时 cancel，正在处理的请求也就可以停止了
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func newClientConn(conn net.Conn, server *server) *clientConn {
+	ctx, cancel := context.WithCancel(context.Background())
 	con := &clientConn{
 		server:  server,
 		conn:    conn,
 		writeCh: make(chan *ResponseBody, writeChanSize),
 		closeCh: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 	// 大接口断言转换成小接口
 	con.codec = server.codec(conn).(ServerCodec)
@@ -120,9 +224,17 @@ func (conn *clientConn) readLoop() {
 			return
 		}
 
+		// 服务端正在关闭，直接告诉客户端，不再处理
+		if !conn.server.startRequest() {
+			conn.reply(&ResponseBody{Seq: req.Seq, Err: errServerClosed.Error()})
+			continue
+		}
+
 		// 开启协程来处理请求
 		// 不知道会产生什么错误？可能导致协程池失效？不理了。
-		_ = gPool.Submit(conn.handleRequest(req))
+		if err = gPool.Submit(conn.handleRequest(req)); err != nil {
+			conn.server.inFlight.Done()
+		}
 	}
 }
 
@@ -133,6 +245,11 @@ func (conn *clientConn) writeLoop() {
 	for {
 		select {
 		case resp := <-conn.writeCh:
+			// flushAndClose 发送的结束标志，前面的 response 都已经写完了
+			if resp == nil {
+				return
+			}
+
 			select {
 			case <-conn.closeCh:
 				return
@@ -156,19 +273,42 @@ func (conn *clientConn) writeLoop() {
 func (conn *clientConn) handleRequest(req *RequestBody) func() {
 	// 利用闭包来捕获变量
 	return func() {
-		timeout := time.Now().Add(sendTimeOutMicrosecond * time.Millisecond)
+		defer conn.server.inFlight.Done()
+
+		// 使用调用方剩余的超时时间，旧版本的客户端没有传则使用默认的
+		// 注意：在协程池排队的时间没有算进去，严格来说应该从读到请求就开始计时
+		timeout := time.Duration(req.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = sendTimeOutMicrosecond * time.Millisecond
+		}
+		ctx, cancel := clock.WithTimeout(conn.ctx, conn.server.clock, timeout)
+		defer cancel()
 
 		// 构造 response
 		resp := &ResponseBody{
 			Seq: req.Seq,
 		}
 
-		byteView, err := conn.server.getValueFunc(req.Key)
+		var byteView byteview.ByteView
+		var err error
+
+		switch req.Op {
+		case OpGet:
+			byteView, err = conn.server.handler.Get(ctx, req.Group, req.Key, req.From)
+		case OpSet:
+			err = conn.server.handler.Set(ctx, req.Group, req.Key, req.Value, time.Duration(req.TTL)*time.Millisecond)
+		case OpRemove:
+			err = conn.server.handler.Remove(ctx, req.Group, req.Key)
+		case OpInvalidate:
+			err = conn.server.handler.Invalidate(ctx, req.Group, req.Key)
+		default:
+			err = fmt.Errorf("unknown op: %d", req.Op)
+		}
 
 		// 为什么不像 transport.GetFromPeer 那种开启一个协程和一个计时器来实现超时？
-		// 其实那种是超时了需要立刻返回的情况，但我这里超时了就超时了，不用一到超时时间就返回，可以一直等到超时结束
-		if timeout.Before(time.Now()) {
-			// 已经超时了，没有必要发过去了
+		// 其实那种是超时了需要立刻返回的情况，但我这里把 ctx 传下去了，由下层自己决定是否提前返回
+		if ctx.Err() != nil {
+			// 已经超时了（或者连接已经关闭），调用方已经放弃了，没有必要发过去了
 			return
 		}
 
@@ -180,16 +320,33 @@ func (conn *clientConn) handleRequest(req *RequestBody) func() {
 		}
 
 		// 发送给客户端
-		select {
-		case conn.writeCh <- resp:
-		default:
-		}
+		conn.reply(resp)
+	}
+}
+
+func (conn *clientConn) reply(resp *ResponseBody) {
+	select {
+	case conn.writeCh <- resp:
+	default:
+	}
+}
+
+// flushAndClose 等 writeCh 中已有的 response 都写完后再关闭连接
+func (conn *clientConn) flushAndClose() {
+	select {
+	// 加入一个结束标志，writeLoop 读到它时，前面的 response 都已经写完了
+	case conn.writeCh <- nil:
+		<-conn.closeCh
+	case <-conn.closeCh:
 	}
+	conn.close()
 }
 
 func (conn *clientConn) close() {
 	conn.closeDo.Do(func() {
+		conn.cancel()
 		close(conn.closeCh)
 		_ = conn.conn.Close()
+		conn.server.removeConn(conn)
 	})
 }
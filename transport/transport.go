@@ -4,35 +4,69 @@ import (
 	"context"
 	"errors"
 	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
 )
 
 const (
-	// 10 秒
+	// 10 秒，调用方的 ctx 没有设置超时时间时使用
 	sendTimeOutMicrosecond = 10000
 )
 
+var errTimeout = errors.New("get from peers timeout")
+
 type Transport interface {
-	GetFromPeer(addr string, key string) ([]byte, error)
+	// GetFromPeer 从 addr 节点的 group 中获取 key
+	// ctx 剩余的超时时间会随请求发送给远程节点，调用方放弃后远程节点也会停止处理
+	GetFromPeer(ctx context.Context, addr string, group string, key string) ([]byte, error)
+	// SetToPeer 让 key 的所属节点 addr 修改缓存，ttl 为 0 表示不过期
+	SetToPeer(ctx context.Context, addr string, group string, key string, value []byte, ttl time.Duration) error
+	// RemoveFromPeer 让 key 的所属节点 addr 删除缓存
+	RemoveFromPeer(ctx context.Context, addr string, group string, key string) error
+	// InvalidatePeer 所属节点通知保存了副本的节点 addr 删除副本
+	InvalidatePeer(ctx context.Context, addr string, group string, key string) error
+	// Close 先关闭服务端（停止监听，等待正在处理的请求返回），再关闭与其他节点的连接
+	Close()
 }
 
 type transport struct {
+	// 本节点地址，随请求发送，让对方知道是谁发的
+	addr   string
 	client *client
 	server *server
 	// 获取编码的方式
 	codec NewCodecFunc
+	// 计算超时时间，见 OptionClock
+	clock clock.Clock
+}
+
+type optionFn func(*transport)
+
+// OptionClock 替换计算超时时间的时钟，客户端的请求超时和服务端处理请求的超时都使用它，默认为 clock.Real
+// 测试时传入 clock.NewFake，手动推进时间就能触发超时
+func OptionClock(clk clock.Clock) func(t *transport) {
+	return func(t *transport) {
+		t.clock = clk
+	}
 }
 
-func NewTransport(addr string, codecType string, valueFunc GetValueFunc) Transport {
+func NewTransport(addr string, codecType string, handler Handler, fns ...optionFn) Transport {
 	codecFunc, ok := codecMap[codecType]
 	if !ok {
 		panic("error codecType")
 	}
 
 	t := &transport{
+		addr:   addr,
 		client: newClient(codecFunc),
 		codec:  codecFunc,
-		server: newServer(addr, codecFunc, valueFunc),
+		server: newServer(addr, codecFunc, handler),
+		clock:  clock.Real,
 	}
+	for i := range fns {
+		fns[i](t)
+	}
+	t.server.clock = t.clock
 
 	// 开启服务器服务
 	go t.server.Serve()
@@ -40,18 +74,71 @@ func NewTransport(addr string, codecType string, valueFunc GetValueFunc) Transpo
 	return t
 }
 
-func (t *transport) GetFromPeer(addr string, key string) ([]byte, error) {
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*sendTimeOutMicrosecond)
+func (t *transport) GetFromPeer(ctx context.Context, addr string, group string, key string) ([]byte, error) {
+	return t.do(ctx, addr, &RequestBody{
+		Op:    OpGet,
+		Key:   key,
+		Group: group,
+	})
+}
+
+func (t *transport) SetToPeer(ctx context.Context, addr string, group string, key string, value []byte, ttl time.Duration) error {
+	_, err := t.do(ctx, addr, &RequestBody{
+		Op:    OpSet,
+		Key:   key,
+		Group: group,
+		Value: value,
+		TTL:   ttl.Milliseconds(),
+	})
+	return err
+}
+
+func (t *transport) RemoveFromPeer(ctx context.Context, addr string, group string, key string) error {
+	_, err := t.do(ctx, addr, &RequestBody{
+		Op:    OpRemove,
+		Key:   key,
+		Group: group,
+	})
+	return err
+}
+
+func (t *transport) InvalidatePeer(ctx context.Context, addr string, group string, key string) error {
+	_, err := t.do(ctx, addr, &RequestBody{
+		Op:    OpInvalidate,
+		Key:   key,
+		Group: group,
+	})
+	return err
+}
+
+func (t *transport) Close() {
+	// 先关闭服务端，正在处理的请求可能还需要通过客户端访问其他节点
+	if t.server != nil {
+		t.server.Close()
+	}
+	t.client.close()
+}
+
+// do 发送请求并等待 response，所有操作都走这里
+func (t *transport) do(ctx context.Context, addr string, req *RequestBody) ([]byte, error) {
+	timeoutCtx, cancel := withDefaultTimeout(ctx, t.clock)
 	// 使得等待在上面的返回，和后面 peerConn.send 对应
 	defer cancel()
 
+	// 剩余的超时时间，不足 1 毫秒就没必要发送了
+	deadline, _ := timeoutCtx.Deadline()
+	remain := clock.Until(t.clock, deadline).Milliseconds()
+	if remain <= 0 {
+		return nil, errTimeout
+	}
+	req.Timeout = remain
+	req.From = t.addr
+
 	call := &call{
-		addr: addr,
-		RequestBody: &RequestBody{
-			Key: key,
-		},
-		valCh:   make(chan []byte),
-		timeout: timeoutCtx,
+		addr:        addr,
+		RequestBody: req,
+		valCh:       make(chan []byte),
+		timeout:     timeoutCtx,
 	}
 
 	go t.client.send(call)
@@ -62,7 +149,7 @@ func (t *transport) GetFromPeer(addr string, key string) ([]byte, error) {
 	// 也就是说实现超时立刻返回功能必须是异步的
 	select {
 	case <-call.timeout.Done():
-		return nil, errors.New("get from peers timeout")
+		return nil, errTimeout
 	case val := <-call.valCh:
 		if call.err != nil {
 			return nil, call.err
@@ -71,6 +158,14 @@ func (t *transport) GetFromPeer(addr string, key string) ([]byte, error) {
 	}
 }
 
+// withDefaultTimeout 调用方没有设置超时时间，则使用默认的超时时间
+func withDefaultTimeout(ctx context.Context, clk clock.Clock) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return clock.WithTimeout(ctx, clk, time.Millisecond*sendTimeOutMicrosecond)
+}
+
 type call struct {
 	addr string
 	*RequestBody
@@ -1,11 +1,14 @@
 package transport
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/ayanghuang/ayangcache/clock"
 )
 
 // Server 这个 Server 是同步接受和发送的，串行化，处理完一个才能处理下一个
@@ -74,7 +77,7 @@ func Server(addr string) {
 
 func getFromPeer(t *transport, addr, key string, wg *sync.WaitGroup) {
 	fmt.Println("----------client send")
-	resp, err := t.GetFromPeer(addr, key)
+	resp, err := t.GetFromPeer(context.Background(), addr, "scores", key)
 	if err != nil {
 		fmt.Println("-----------------------------client receive error", err.Error())
 	} else {
@@ -97,6 +100,7 @@ func TestTransport_GetFromPeer(t *testing.T) {
 	codec, _ := codecMap[ProtobufType]
 	ts := &transport{
 		client: newClient(codec),
+		clock:  clock.Real,
 	}
 
 	wg := &sync.WaitGroup{}
@@ -120,6 +124,7 @@ func TestTransport_GetFromPeer_Timeout(t *testing.T) {
 	codec, _ := codecMap[ProtobufType]
 	ts := &transport{
 		client: newClient(codec),
+		clock:  clock.Real,
 	}
 
 	wg := &sync.WaitGroup{}
@@ -145,6 +150,7 @@ func TestTransport_GetFromPeer_Close(t *testing.T) {
 	codec, _ := codecMap[ProtobufType]
 	ts := &transport{
 		client: newClient(codec),
+		clock:  clock.Real,
 	}
 
 	wg := &sync.WaitGroup{}
@@ -157,3 +163,32 @@ func TestTransport_GetFromPeer_Close(t *testing.T) {
 	wg.Wait()
 	time.Sleep(time.Second)
 }
+
+// 验证调用方的超时时间：服务器处理需要 7 秒，调用方只等 200 毫秒
+func TestTransport_GetFromPeer_Context(t *testing.T) {
+	serverAddr := "127.0.0.1:9983"
+	go Server(serverAddr)
+	time.Sleep(time.Second)
+
+	codec, _ := codecMap[ProtobufType]
+	ts := &transport{
+		client: newClient(codec),
+		clock:  clock.Real,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := ts.GetFromPeer(ctx, serverAddr, "scores", "timeout"); err == nil {
+		t.Fatalf("should timeout")
+	}
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("should return after 200ms, but %v", cost)
+	}
+
+	// 已经超时的 ctx 直接返回，不会发送
+	if _, err := ts.GetFromPeer(ctx, serverAddr, "scores", "ayang"); err == nil {
+		t.Fatalf("should timeout")
+	}
+}
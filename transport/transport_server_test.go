@@ -1,10 +1,13 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/ayanghuang/ayangcache/byteview"
+	"github.com/ayanghuang/ayangcache/clock"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -20,14 +23,51 @@ var cache map[string]interface{}
 
 var codec NewCodecFunc
 
-var mockGetValueFunc GetValueFunc = func(key string) (byteview.ByteView, error) {
+type mockHandler struct {
+	mutex sync.Mutex
+}
+
+func (h *mockHandler) Get(ctx context.Context, group, key, _ string) (byteview.ByteView, error) {
+	// 模拟处理很慢，直到调用方放弃
+	if key == "slow" {
+		<-ctx.Done()
+		return byteview.ByteView{}, ctx.Err()
+	}
+	// 模拟处理需要一段时间
+	if key == "delay" {
+		time.Sleep(200 * time.Millisecond)
+		key = "ayang"
+	}
+	if group != "scores" {
+		return byteview.ByteView{}, errors.New("no such group: " + group)
+	}
+	h.mutex.Lock()
 	v, ok := cache[key]
+	h.mutex.Unlock()
 	if !ok {
 		return byteview.ByteView{}, errors.New("have no this cache")
 	}
 	return byteview.NewByteView(v.([]byte)), nil
 }
 
+func (h *mockHandler) Set(_ context.Context, _, key string, value []byte, _ time.Duration) error {
+	h.mutex.Lock()
+	cache[key] = value
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *mockHandler) Remove(_ context.Context, _, key string) error {
+	h.mutex.Lock()
+	delete(cache, key)
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *mockHandler) Invalidate(_ context.Context, _, _ string) error {
+	return errors.New("not holder")
+}
+
 // 简单的串行化的 Client，反复进行读 request，写 response。不能边读边写。
 func Client(keys ...string) {
 	var err error
@@ -47,8 +87,9 @@ func Client(keys ...string) {
 
 	for index := range keys {
 		req = &RequestBody{
-			Seq: uint64(index),
-			Key: keys[index],
+			Seq:   uint64(index),
+			Key:   keys[index],
+			Group: "scores",
 		}
 
 		err = codec.WriteRequest(req)
@@ -67,7 +108,7 @@ func Client(keys ...string) {
 }
 
 func TestServer_Serve(t *testing.T) {
-	server := newServer("127.0.0.1:9990", codec, mockGetValueFunc)
+	server := newServer("127.0.0.1:9990", codec, &mockHandler{})
 	go server.Serve()
 	time.Sleep(time.Second)
 
@@ -76,3 +117,183 @@ func TestServer_Serve(t *testing.T) {
 	Client(keys...)
 	time.Sleep(time.Second)
 }
+
+// TestServer_Deadline 超过请求中的剩余时间，服务端不再发送 response
+func TestServer_Deadline(t *testing.T) {
+	server := newServer("127.0.0.1:9991", codec, &mockHandler{})
+	go server.Serve()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9991")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	c := NewProtobufCodec(conn).(ClientCodec)
+	_ = c.WriteRequest(&RequestBody{Seq: 1, Key: "slow", Group: "scores", Timeout: 100})
+	_ = c.WriteRequest(&RequestBody{Seq: 2, Key: "ayang", Group: "scores", Timeout: 1000})
+
+	// 只会收到 seq 2 的 response
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	resp := &ResponseBody{}
+	if err = c.ReadResponseBody(resp); err != nil || resp.Seq != 2 {
+		t.Fatalf("should receive seq 2")
+	}
+	resp = &ResponseBody{}
+	if err = c.ReadResponseBody(resp); err == nil {
+		t.Fatalf("should not receive seq %d", resp.Seq)
+	}
+}
+
+// TestTransport_SetRemove 通过 transport 修改、删除远程节点的缓存
+func TestTransport_SetRemove(t *testing.T) {
+	server := newServer("127.0.0.1:9992", codec, &mockHandler{})
+	go server.Serve()
+	time.Sleep(time.Second)
+
+	ts := &transport{
+		addr:   "127.0.0.1:9993",
+		client: newClient(codec),
+		clock:  clock.Real,
+	}
+	ctx := context.Background()
+	addr := "127.0.0.1:9992"
+
+	if err := ts.SetToPeer(ctx, addr, "scores", "jerry", []byte("jerryValue"), time.Second); err != nil {
+		t.Fatalf("SetToPeer failed: %s", err.Error())
+	}
+	if v, err := ts.GetFromPeer(ctx, addr, "scores", "jerry"); err != nil || string(v) != "jerryValue" {
+		t.Fatalf("GetFromPeer after SetToPeer failed")
+	}
+
+	// 超过 64KB 的 value 直接返回错误，连接还可以继续使用
+	if err := ts.SetToPeer(ctx, addr, "scores", "jerry", make([]byte, maxFrameSize), time.Second); err != errFrameTooLarge {
+		t.Fatalf("SetToPeer too large err = %v", err)
+	}
+	if v, err := ts.GetFromPeer(ctx, addr, "scores", "jerry"); err != nil || string(v) != "jerryValue" {
+		t.Fatalf("GetFromPeer after too large SetToPeer failed")
+	}
+
+	if err := ts.RemoveFromPeer(ctx, addr, "scores", "jerry"); err != nil {
+		t.Fatalf("RemoveFromPeer failed: %s", err.Error())
+	}
+	if _, err := ts.GetFromPeer(ctx, addr, "scores", "jerry"); err == nil {
+		t.Fatalf("GetFromPeer after RemoveFromPeer should fail")
+	}
+
+	// 服务端的错误会传回来
+	if err := ts.InvalidatePeer(ctx, addr, "scores", "jerry"); err == nil || err.Error() != "not holder" {
+		t.Fatalf("InvalidatePeer should return server error")
+	}
+}
+
+// TestServer_Close 关闭时等待正在处理的请求返回，之后不再接受连接
+func TestServer_Close(t *testing.T) {
+	server := newServer("127.0.0.1:9994", codec, &mockHandler{})
+	go server.Serve()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9994")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	c := NewProtobufCodec(conn).(ClientCodec)
+	_ = c.WriteRequest(&RequestBody{Seq: 1, Key: "delay", Group: "scores", Timeout: 1000})
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+
+	// 正在处理的请求还是能收到 response
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	resp := &ResponseBody{}
+	if err = c.ReadResponseBody(resp); err != nil || resp.Seq != 1 || string(resp.Value) != "ayangValue" {
+		t.Fatalf("should receive seq 1 before close")
+	}
+
+	<-closed
+	// 连接已经被服务端关闭
+	if err = c.ReadResponseBody(&ResponseBody{}); err == nil {
+		t.Fatalf("conn should be closed")
+	}
+	if _, err = net.Dial("tcp", "127.0.0.1:9994"); err == nil {
+		t.Fatalf("should not accept new conn after close")
+	}
+
+	// 可以重复关闭
+	server.Close()
+}
+
+// TestTransport_Close 关闭后不再发送请求
+func TestTransport_Close(t *testing.T) {
+	server := newServer("127.0.0.1:9995", codec, &mockHandler{})
+	go server.Serve()
+	time.Sleep(time.Second)
+	defer server.Close()
+
+	ts := NewTransport("127.0.0.1:9996", ProtobufType, &mockHandler{})
+	time.Sleep(100 * time.Millisecond)
+	ctx := context.Background()
+
+	if _, err := ts.GetFromPeer(ctx, "127.0.0.1:9995", "scores", "ayang"); err != nil {
+		t.Fatalf("GetFromPeer failed: %s", err.Error())
+	}
+
+	ts.Close()
+	if _, err := ts.GetFromPeer(ctx, "127.0.0.1:9995", "scores", "ayang"); err != errClientClosed {
+		t.Fatalf("GetFromPeer after close should fail, but %v", err)
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:9996"); err == nil {
+		t.Fatalf("should not accept new conn after close")
+	}
+}
+
+// TestTransport_FakeClock 超时由 clock 决定，推进假时钟就能让客户端和服务端同时超时，不需要真的等 10 秒
+func TestTransport_FakeClock(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	ts := NewTransport("127.0.0.1:9997", ProtobufType, &mockHandler{}, OptionClock(clk))
+	defer ts.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	errCh := make(chan error, 1)
+	go func() {
+		// 没有设置超时时间，使用默认的 10 秒
+		_, err := ts.GetFromPeer(context.Background(), "127.0.0.1:9997", "scores", "slow")
+		errCh <- err
+	}()
+
+	// 等待客户端和服务端都开始计时
+	for i := 0; i < 100 && clk.Timers() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := clk.Timers(); n != 2 {
+		t.Fatalf("Timers = %d, want 2", n)
+	}
+
+	clk.Add(sendTimeOutMicrosecond*time.Millisecond - time.Millisecond)
+	select {
+	case err := <-errCh:
+		t.Fatalf("returned before timeout: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Add(time.Millisecond)
+	select {
+	case err := <-errCh:
+		if err != errTimeout {
+			t.Fatalf("err = %v, want errTimeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should timeout after the fake clock advanced")
+	}
+}